@@ -0,0 +1,110 @@
+// Copyright (C) 2016 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config defines the configuration file of the exporter
+type Config struct {
+	Targets []Target `yaml:"targets"`
+}
+
+// Target defines how to reach a Synology Diskstation
+type Target struct {
+	Diskstation     string        `yaml:"diskstation"`
+	Name            string        `yaml:"name,omitempty"`
+	Community       string        `yaml:"community,omitempty"`
+	Version         string        `yaml:"version,omitempty"`
+	Transport       string        `yaml:"transport,omitempty"`
+	LocalAddress    string        `yaml:"local_address,omitempty"`
+	Interval        time.Duration `yaml:"interval,omitempty"`
+	ResolveInterval time.Duration `yaml:"resolve_interval,omitempty"`
+	MaxRepetitions  int           `yaml:"max_repetitions,omitempty"`
+	NonRepeaters    int           `yaml:"non_repeaters,omitempty"`
+	MaxOids         int           `yaml:"max_oids,omitempty"`
+	Retries         int           `yaml:"retries,omitempty"`
+	V3              V3            `yaml:"v3,omitempty" json:"v3,omitempty"`
+	Plugins         []string      `yaml:"plugins,omitempty"`
+
+	// CPUPerCore and NetPerInterface export the CPU load of each core and
+	// the counters of each network interface, besides the totals
+	CPUPerCore      bool `yaml:"cpu_per_core,omitempty"`
+	NetPerInterface bool `yaml:"net_per_interface,omitempty"`
+
+	// SystemFanSpeed exports the speed of the fans, on the models which
+	// report it
+	SystemFanSpeed bool `yaml:"system_fan_speed,omitempty"`
+
+	// SkipNotIncreasing skips the variables whose OID doesn't increase in
+	// the table walks, instead of failing them
+	SkipNotIncreasing bool `yaml:"skip_not_increasing,omitempty"`
+
+	// OIDBases override the base OID of the plugins, by name, when a DSM
+	// version moves their OIDs
+	OIDBases map[string]string `yaml:"oid_bases,omitempty"`
+
+	// CustomOIDs are the OIDs to export as syno_custom_<name>, by name
+	CustomOIDs map[string]string `yaml:"custom_oids,omitempty"`
+}
+
+// V3 defines the SNMPv3 User Security Model credentials
+type V3 struct {
+	Username     string `yaml:"username,omitempty" json:"username,omitempty"`
+	AuthProtocol string `yaml:"auth_protocol,omitempty" json:"auth_protocol,omitempty"`
+	AuthPassword string `yaml:"auth_password,omitempty" json:"auth_password,omitempty"`
+	PrivProtocol string `yaml:"priv_protocol,omitempty" json:"priv_protocol,omitempty"`
+	PrivPassword string `yaml:"priv_password,omitempty" json:"priv_password,omitempty"`
+
+	// ContextName and ContextEngineID select the SNMPv3 context of the
+	// requests. The engine ID is in hexadecimal, and defaults to the one of
+	// the agent.
+	ContextName     string `yaml:"context_name,omitempty" json:"context_name,omitempty"`
+	ContextEngineID string `yaml:"context_engine_id,omitempty" json:"context_engine_id,omitempty"`
+}
+
+// Load reads and parses the YAML configuration file
+func Load(filename string) (*Config, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read configuration file %s: %s", filename, err)
+	}
+	var cfg Config
+	if err := yaml.UnmarshalStrict(content, &cfg); err != nil {
+		return nil, fmt.Errorf("Can't parse configuration file %s: %s", filename, err)
+	}
+	for i, target := range cfg.Targets {
+		if target.Diskstation == "" {
+			return nil, fmt.Errorf("Target %d of %s: missing diskstation", i, filename)
+		}
+	}
+	return &cfg, nil
+}
+
+// Target returns the configuration of the given Diskstation, or nil if it's
+// not defined.
+func (c *Config) Target(diskstation string) *Target {
+	for i := range c.Targets {
+		if c.Targets[i].Diskstation == diskstation {
+			return &c.Targets[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+// Copyright (C) 2016 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syno
+
+import (
+	"github.com/prometheus/common/log"
+	"github.com/soniah/gosnmp"
+
+	"github.com/nlamirault/syno_exporter/syno/plugins"
+)
+
+// batchedSession is the Session given to the plugins: their Get requests are
+// split into requests of at most MaxOids OIDs, as the Diskstation rejects the
+// larger ones.
+type batchedSession struct {
+	Session
+	client *Client
+}
+
+func (s batchedSession) Get(oids []string) (*gosnmp.SnmpPacket, error) {
+	return s.client.batchGet(s.Session, oids)
+}
+
+// maxOids returns the maximum number of OIDs of a Get request
+func (c *Client) maxOids() int {
+	if c.SNMP.MaxOids <= 0 {
+		return gosnmp.MaxOids
+	}
+	return c.SNMP.MaxOids
+}
+
+// batchGet gets the values of the OIDs with Get requests of at most MaxOids
+// OIDs, and merges their responses. When the Diskstation answers tooBig, the
+// request is sent again with half of its OIDs, and the smaller size is kept
+// for the next requests. Another error status fails the whole Get with a
+// *plugins.StatusError, whose index is the one of the OID in oids. Without
+// OIDs, the response is empty.
+func (c *Client) batchGet(session Session, oids []string) (*gosnmp.SnmpPacket, error) {
+	size := c.maxOids()
+	c.mu.Lock()
+	if c.batchSize > 0 && c.batchSize < size {
+		size = c.batchSize
+	}
+	c.mu.Unlock()
+	result := &gosnmp.SnmpPacket{}
+	for start := 0; start < len(oids); {
+		end := start + size
+		if end > len(oids) {
+			end = len(oids)
+		}
+		packet, err := session.Get(oids[start:end])
+		if err != nil {
+			return nil, err
+		}
+		if packet.Error == gosnmp.TooBig && end-start > 1 {
+			size = (end - start) / 2
+			log.Debugf("[Client] Response to %d OIDs too big, retrying with %d OIDs per request", end-start, size)
+			c.mu.Lock()
+			c.batchSize = size
+			c.mu.Unlock()
+			continue
+		}
+		if packet.Error != gosnmp.NoError {
+			index := int(packet.ErrorIndex)
+			if index > 0 {
+				index += start
+			}
+			return nil, &plugins.StatusError{Status: packet.Error, Index: index}
+		}
+		if start == 0 {
+			result = packet
+		} else {
+			result.Variables = append(result.Variables, packet.Variables...)
+		}
+		start = end
+	}
+	return result, nil
+}
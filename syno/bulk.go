@@ -0,0 +1,196 @@
+// Copyright (C) 2016 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syno
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/common/log"
+	"github.com/soniah/gosnmp"
+
+	"github.com/nlamirault/syno_exporter/syno/plugins"
+)
+
+// bulkRequests identifies the requests sent by GetBulkAll in the SNMP
+// requests counters.
+const bulkRequests = "bulk"
+
+type prefetchedKey struct{}
+
+// Prefetch retrieves in bulk the values of the enabled scalar plugins, and
+// returns a context giving them to the collections of these plugins. If it
+// fails, the plugins fetch their values themselves.
+func (c *Client) Prefetch(ctx context.Context) context.Context {
+	var oids []string
+	for _, name := range c.PluginNames() {
+		if scalar, ok := c.Plugins[name].(plugins.ScalarPlugin); ok {
+			oids = append(oids, scalar.OIDs()...)
+		}
+	}
+	if len(oids) == 0 {
+		return ctx
+	}
+
+	if err := ctx.Err(); err != nil {
+		return ctx
+	}
+	if c.Down() != nil {
+		return ctx
+	}
+	s, err := c.acquire(ctx)
+	if err != nil {
+		return ctx
+	}
+	defer c.release(s)
+	if err := c.connect(s); err != nil {
+		log.Debugf("[Client] Can't prefetch the scalar values: %v", err)
+		return ctx
+	}
+	var variables map[string]gosnmp.SnmpPDU
+	err = c.abortable(ctx, s, func() error {
+		var err error
+		variables, err = c.getBulkAll(s, oids)
+		return err
+	})
+	c.mu.Lock()
+	c.recordAgent(err)
+	c.mu.Unlock()
+	if err != nil {
+		log.Debugf("[Client] Can't prefetch the scalar values: %v", err)
+		return ctx
+	}
+	return context.WithValue(ctx, prefetchedKey{}, variables)
+}
+
+// prefetched returns the values retrieved by Prefetch, if any
+func prefetched(ctx context.Context) map[string]gosnmp.SnmpPDU {
+	variables, _ := ctx.Value(prefetchedKey{}).(map[string]gosnmp.SnmpPDU)
+	return variables
+}
+
+// GetBulkAll retrieves the values of the OIDs with as few requests as
+// possible, keyed by OID. With SNMPv2c and v3, they are sent in GetBulk
+// requests where every OID is a non-repeater, so the responses hold one
+// value per OID whatever MaxRepetitions. SNMPv1 has no GetBulk, so Get
+// requests are used.
+func (c *Client) GetBulkAll(oids []string) (map[string]gosnmp.SnmpPDU, error) {
+	s, err := c.acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(s)
+	if err := c.connect(s); err != nil {
+		return nil, err
+	}
+	return c.getBulkAll(s, oids)
+}
+
+func (c *Client) getBulkAll(s *session, oids []string) (map[string]gosnmp.SnmpPDU, error) {
+	// At most MaxOids per request, which also fits the non-repeaters uint8
+	size := c.SNMP.MaxOids
+	if size <= 0 || size > gosnmp.MaxOids {
+		size = gosnmp.MaxOids
+	}
+	variables := map[string]gosnmp.SnmpPDU{}
+	for start := 0; start < len(oids); start += size {
+		end := start + size
+		if end > len(oids) {
+			end = len(oids)
+		}
+		batch := oids[start:end]
+		if c.SNMP.Version == gosnmp.Version1 {
+			if err := c.bulkGet(s, batch, variables); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// GetBulk returns the OIDs following the requested ones, so ask
+		// for their predecessors.
+		previous := make([]string, len(batch))
+		for i, oid := range batch {
+			previous[i] = previousOID(oid)
+		}
+		result, err := s.GetBulk(previous, uint8(len(previous)), 0)
+		c.recordRequest(bulkRequests, "getbulk", err)
+		if err != nil {
+			return nil, err
+		}
+		wanted := map[string]bool{}
+		for _, oid := range batch {
+			wanted[oid] = true
+		}
+		for _, variable := range result.Variables {
+			if wanted[variable.Name] {
+				variables[variable.Name] = variable
+			}
+		}
+
+		// The predecessor isn't always right before the OID (e.g. when it
+		// doesn't exist in the agent), so get the missing ones.
+		var missing []string
+		for _, oid := range batch {
+			if _, ok := variables[oid]; !ok {
+				missing = append(missing, oid)
+			}
+		}
+		if len(missing) > 0 {
+			if err := c.bulkGet(s, missing, variables); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return variables, nil
+}
+
+// bulkGet gets the values of the OIDs into variables
+func (c *Client) bulkGet(s *session, oids []string, variables map[string]gosnmp.SnmpPDU) error {
+	result, err := s.Get(oids)
+	c.recordRequest(bulkRequests, "get", err)
+	if err != nil {
+		return err
+	}
+	if err := plugins.CheckResponse(oids, result); err != nil {
+		return err
+	}
+	for _, variable := range result.Variables {
+		variables[variable.Name] = variable
+	}
+	return nil
+}
+
+// recordRequest counts a SNMP request sent by a plugin, GetBulkAll or Set
+func (c *Client) recordRequest(plugin string, request string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests[SNMPRequest{Plugin: plugin, Type: request}]++
+	if err != nil {
+		c.requestErrors[SNMPRequest{Plugin: plugin, Type: request}]++
+	}
+}
+
+// previousOID returns an OID which is followed by the given one: the parent
+// of the first instance, .0, or the previous sibling otherwise.
+func previousOID(oid string) string {
+	i := strings.LastIndex(oid, ".")
+	last, err := strconv.Atoi(oid[i+1:])
+	if err != nil || last == 0 {
+		return oid[:i]
+	}
+	return fmt.Sprintf("%s.%d", oid[:i], last-1)
+}
@@ -15,9 +15,14 @@
 package syno
 
 import (
-	// "fmt"
-	// "log"
-	// "net"
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/common/log"
@@ -26,95 +31,760 @@ import (
 	"github.com/nlamirault/syno_exporter/syno/plugins"
 )
 
+const (
+	// DefaultInterval is the interval used when none is configured
+	DefaultInterval = 60 * time.Second
+
+	// DefaultFetchRetries is how many times a failed plugin is retried
+	// when none is configured
+	DefaultFetchRetries = 1
+
+	// DefaultConcurrency is the number of plugins collected at the same
+	// time when none is configured, so we don't flood the Diskstation SNMP
+	// agent
+	DefaultConcurrency = 3
+
+	// retryBackoff is the delay before the first retry of a plugin. It
+	// doubles at each retry.
+	retryBackoff = 100 * time.Millisecond
+
+	// sysDescr from SNMPv2-MIB
+	oidSysDescr = ".1.3.6.1.2.1.1.1.0"
+
+	// agentDownBackoff is how long the collections are skipped once the
+	// SNMP agent is down. It doubles at each failed attempt, up to
+	// maxAgentDownBackoff.
+	agentDownBackoff    = 30 * time.Second
+	maxAgentDownBackoff = 10 * time.Minute
+
+	// agentDownTimeouts is the number of consecutive timed out requests
+	// after which the agent is down. A refused request is enough.
+	agentDownTimeouts = 3
+
+	// errConnectionRefused is the message of ECONNREFUSED, kept by the
+	// gosnmp read errors when the Diskstation refused the request
+	errConnectionRefused = "connection refused"
+)
+
 // Client defines the Synology SNMP client
 type Client struct {
 	Diskstation string
 	Interval    time.Duration
 	Plugins     map[string]plugins.Plugin
-	SNMP        *gosnmp.GoSNMP
+
+	// SNMP holds the SNMP settings of the Diskstation: target, version,
+	// credentials, ... The requests are sent by the sessions of a pool,
+	// opened by NewSession (NewSession by default) with a copy of these
+	// settings when the client is first used.
+	SNMP       *gosnmp.GoSNMP
+	NewSession func(snmp *gosnmp.GoSNMP) Session
+
+	// Concurrency is the number of sessions of the pool, i.e. of plugins
+	// collected at the same time.
+	Concurrency int
+
+	openPool sync.Once
+	sessions chan *session
+
+	// mu guards the state of the client below. It's only held to update
+	// it, never during the SNMP requests.
+	mu sync.Mutex
+
+	// reconnects counts how many times a dead connection was reopened
+	reconnects uint64
+
+	// walkAnomalies counts the variables skipped by the walks, as their OID
+	// didn't increase
+	walkAnomalies uint64
+
+	// decodeErrors counts the SNMP responses which couldn't be decoded
+	decodeErrors uint64
+
+	// retries counts the SNMP requests sent again by gosnmp
+	retries uint64
+
+	// ResolveInterval is how often the host name of the Diskstation is
+	// resolved again, for Diskstations whose address changes (DHCP). Zero
+	// means it's resolved once.
+	ResolveInterval time.Duration
+
+	// host is the Diskstation IP or host name, and resolved the last time
+	// it was resolved to the SNMP target IP.
+	host     string
+	resolved time.Time
+
+	// CacheMaxAge is how long the last metrics successfully fetched by a
+	// plugin are served when it fails. Zero disables the cache.
+	CacheMaxAge time.Duration
+
+	// FetchRetries is how many times a plugin is run again, on a new
+	// connection, when its SNMP requests failed on a transient error
+	// (timeout, network error). The retries are given up when no scrape
+	// waits for the collection anymore.
+	FetchRetries int
+
+	// cache, stale, durations, requests, requestErrors, counters and
+	// counterWraps are guarded by mu
+	cache         map[string]cachedMetrics
+	stale         map[string]bool
+	durations     map[string]time.Duration
+	requests      map[SNMPRequest]uint64
+	requestErrors map[SNMPRequest]uint64
+
+	// counters are the last values of the 32 bits counters, by OID, and
+	// counterWraps how many times one of them decreased.
+	counters     map[string]float64
+	counterWraps uint64
+
+	// batchSize is the number of OIDs of the Get requests of the plugins,
+	// lowered when the Diskstation answers tooBig. Zero means MaxOids.
+	// Guarded by mu.
+	batchSize int
+
+	// down is set when the SNMP agent refuses the requests or doesn't
+	// answer them, e.g. as SNMP is disabled in DSM: the collections fail
+	// right away until downUntil. Guarded by mu.
+	down        bool
+	downUntil   time.Time
+	downBackoff time.Duration
+	timeouts    int
+
+	// engine caches the SNMPv3 engine of the Diskstation across the
+	// scrapes, and engineStale is set when it must be discovered again.
+	// Guarded by mu.
+	engine      usmEngine
+	engineStale bool
+
+	// flights are the collections in progress, by plugin, shared by the
+	// concurrent scrapes
+	flightsMu sync.Mutex
+	flights   map[string]*flight
 }
 
-// NewClient defines a new client for the Synology Diskstation
+// SNMPRequest identifies the SNMP requests of a type (get or walk) sent by a
+// plugin.
+type SNMPRequest struct {
+	Plugin string
+	Type   string
+}
+
+// cachedMetrics are the last metrics successfully fetched by a plugin
+type cachedMetrics struct {
+	metrics interface{}
+	fetched time.Time
+}
+
+// NewClient defines a new client for the Synology Diskstation. Its address
+// is an IPv4 or IPv6 address or a host name, optionally followed by the SNMP
+// port, e.g. 192.168.1.11:161 or [fd00::11]:161.
 func NewClient(dsIP string, interval time.Duration) (*Client, error) {
 	log.Debugf("New SNMP Client for Synology Disksation: %s", dsIP)
-	return &Client{
-		Diskstation: dsIP,
-		Interval:    interval,
+	if err := ValidateDiskstation(dsIP); err != nil {
+		return nil, err
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("Invalid interval for %s: %s", dsIP, interval)
+	}
+	host, port, _ := splitHostPort(dsIP)
+	snmp := &gosnmp.GoSNMP{
+		Target:    host,
+		Port:      port,
+		Community: "public",
+		Version:   gosnmp.Version1,
+		Timeout:   time.Duration(2) * time.Second,
+	}
+	client := &Client{
+		Diskstation:  dsIP,
+		Interval:     interval,
+		host:         host,
+		FetchRetries: DefaultFetchRetries,
+		Concurrency:  DefaultConcurrency,
 		Plugins: map[string]plugins.Plugin{
-			"disk":   plugins.DiskPlugin{},
-			"load":   plugins.LoadPlugin{},
-			"cpu":    plugins.CPUPlugin{},
-			"mem":    plugins.MemoryPlugin{},
-			"net":    plugins.NetworkPlugin{},
-			"system": plugins.SystemPlugin{},
-		},
-		SNMP: &gosnmp.GoSNMP{
-			Target:    dsIP,
-			Port:      161,
-			Community: "public",
-			Version:   gosnmp.Version1,
-			Timeout:   time.Duration(2) * time.Second,
+			"disk":    plugins.DiskPlugin{},
+			"diskio":  plugins.DiskIOPlugin{},
+			"load":    plugins.LoadPlugin{},
+			"cpu":     plugins.CPUPlugin{},
+			"mem":     plugins.MemoryPlugin{},
+			"net":     plugins.NetworkPlugin{},
+			"service": plugins.ServicePlugin{},
+			"space":   plugins.SpacePlugin{},
+			"storage": plugins.StoragePlugin{},
+			"system":  plugins.SystemPlugin{},
 		},
-	}, nil
+		SNMP:          snmp,
+		NewSession:    NewSession,
+		cache:         map[string]cachedMetrics{},
+		stale:         map[string]bool{},
+		durations:     map[string]time.Duration{},
+		requests:      map[SNMPRequest]uint64{},
+		requestErrors: map[SNMPRequest]uint64{},
+		counters:      map[string]float64{},
+		flights:       map[string]*flight{},
+	}
+	snmp.OnDecodeError = func(err error) {
+		log.Debugf("[Client] Invalid SNMP response from %s: %v", dsIP, err)
+		atomic.AddUint64(&client.decodeErrors, 1)
+	}
+	snmp.OnRetry = func(retry int) {
+		log.Debugf("[Client] Retry %d of the SNMP request to %s", retry, dsIP)
+		atomic.AddUint64(&client.retries, 1)
+	}
+	snmp.OnSecurityParameters = client.storeEngine
+	snmp.OnReport = client.engineReport
+	return client, nil
 }
 
+// ValidateDiskstation checks the address of a Diskstation: an IP or a host
+// name, optionally followed by the SNMP port.
+func ValidateDiskstation(address string) error {
+	if address == "" {
+		return fmt.Errorf("Missing Diskstation address")
+	}
+	host, _, err := splitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if net.ParseIP(host) == nil && !isHostName(host) {
+		return fmt.Errorf("Invalid Diskstation address %s: not an IP nor a host name", address)
+	}
+	return nil
+}
+
+// isHostName checks the syntax of a host name (RFC 1123). Names with only
+// numeric labels are malformed IPv4 addresses.
+func isHostName(host string) bool {
+	host = strings.TrimSuffix(host, ".")
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	numeric := true
+	for _, label := range strings.Split(host, ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			switch {
+			case c >= '0' && c <= '9':
+			case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '-', c == '_':
+				numeric = false
+			default:
+				return false
+			}
+		}
+	}
+	return !numeric
+}
+
+// splitHostPort splits the address of the Diskstation into the host, without
+// the brackets of IPv6 literals, and the port, 161 if it's not given.
+func splitHostPort(address string) (string, uint16, error) {
+	host, port := address, "161"
+	if strings.HasPrefix(address, "[") && !strings.HasSuffix(address, "]") || strings.Count(address, ":") == 1 {
+		var err error
+		if host, port, err = net.SplitHostPort(address); err != nil {
+			return "", 0, fmt.Errorf("Invalid Diskstation address %s: %s", address, err)
+		}
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	number, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("Invalid SNMP port for %s: %s", address, port)
+	}
+	return host, uint16(number), nil
+}
+
+// EnablePlugins restricts the collection to the given plugins
+func (c *Client) EnablePlugins(names []string) error {
+	enabled := map[string]plugins.Plugin{}
+	for _, name := range names {
+		plugin, ok := c.Plugins[name]
+		if !ok {
+			return fmt.Errorf("Unknown plugin: %s (available: %s)", name, strings.Join(c.PluginNames(), ","))
+		}
+		enabled[name] = plugin
+	}
+	c.Plugins = enabled
+	return nil
+}
+
+// PluginNames returns the sorted names of the enabled plugins
+func (c *Client) PluginNames() []string {
+	names := make([]string, 0, len(c.Plugins))
+	for name := range c.Plugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Connect opens the SNMP connection to the Diskstation. The connection is
+// kept and reused across scrapes, so it's a no-op if it's already opened.
 func (c *Client) Connect() error {
-	return c.SNMP.Connect()
+	s, err := c.acquire(context.Background())
+	if err != nil {
+		return err
+	}
+	defer c.release(s)
+	return c.connect(s)
+}
+
+// Close releases the SNMP connections to the Diskstation, once the pending
+// requests are done.
+func (c *Client) Close() error {
+	var sessions []*session
+	for len(sessions) < cap(c.pool()) {
+		s, err := c.acquire(context.Background())
+		if err != nil {
+			return err
+		}
+		sessions = append(sessions, s)
+	}
+	var err error
+	for _, s := range sessions {
+		if closeErr := s.Close(); closeErr != nil {
+			err = closeErr
+		}
+		c.release(s)
+	}
+	return err
+}
+
+// Ping checks that the Diskstation answers to SNMP requests, with a
+// lightweight Get of the system description.
+func (c *Client) Ping() error {
+	s, err := c.acquire(context.Background())
+	if err != nil {
+		return err
+	}
+	defer c.release(s)
+	if err := c.connect(s); err != nil {
+		return err
+	}
+	result, err := s.Get([]string{oidSysDescr})
+	if err != nil {
+		return err
+	}
+	if len(result.Variables) == 0 || result.Variables[0].Type != gosnmp.OctetString {
+		return fmt.Errorf("Invalid SNMP response for sysDescr: %v", result.Variables)
+	}
+	return nil
+}
+
+// Down returns an error while the SNMP agent of the Diskstation is down and
+// the collections are skipped, or nil if it may be queried.
+func (c *Client) Down() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.downError()
+}
+
+func (c *Client) downError() error {
+	if !c.down || time.Now().After(c.downUntil) {
+		return nil
+	}
+	return fmt.Errorf("SNMP agent of %s down, next attempt at %s",
+		c.Diskstation, c.downUntil.Format("15:04:05"))
+}
+
+// recordAgent tracks whether the SNMP agent answers, from the error of a
+// collection. The collections are skipped, with an exponential backoff, once
+// it refused a request or several requests timed out. mu must be held.
+func (c *Client) recordAgent(err error) {
+	switch {
+	case err == nil:
+		if c.down {
+			log.Infof("[Client] SNMP agent of %s is back", c.Diskstation)
+		}
+		c.down, c.downBackoff, c.timeouts = false, 0, 0
+		return
+	case strings.Contains(err.Error(), errConnectionRefused):
+	case strings.Contains(err.Error(), gosnmp.ErrTimeout):
+		c.timeouts++
+		if c.timeouts < agentDownTimeouts {
+			return
+		}
+	default:
+		return
+	}
+
+	if c.down {
+		c.downBackoff *= 2
+		if c.downBackoff > maxAgentDownBackoff {
+			c.downBackoff = maxAgentDownBackoff
+		}
+		log.Debugf("[Client] SNMP agent of %s still down, next attempt in %s: %v", c.Diskstation, c.downBackoff, err)
+	} else {
+		c.downBackoff = agentDownBackoff
+		log.Warnf("[Client] SNMP agent of %s doesn't answer, enable SNMP in DSM Control Panel > Terminal & SNMP and check the community (next attempt in %s): %v",
+			c.Diskstation, c.downBackoff, err)
+	}
+	c.down = true
+	c.downUntil = time.Now().Add(c.downBackoff)
+}
+
+// Stale returns true if the last metrics of the plugin were served from the
+// cache, as it failed to fetch them.
+func (c *Client) Stale(plugin string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stale[plugin]
+}
+
+// Duration returns how long the last collection of the plugin took
+func (c *Client) Duration(plugin string) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.durations[plugin]
 }
 
-func (c *Client) SystemMetrics() (map[string]float64, error) {
-	log.Infof("[Client] Collect System metrics")
-	return c.collect(c.Plugins["system"])
+// Requests returns the number of SNMP requests sent by the plugins, and the
+// number of those which failed.
+func (c *Client) Requests() (requests map[SNMPRequest]uint64, errors map[SNMPRequest]uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	requests = make(map[SNMPRequest]uint64, len(c.requests))
+	for request, count := range c.requests {
+		requests[request] = count
+	}
+	errors = make(map[SNMPRequest]uint64, len(c.requestErrors))
+	for request, count := range c.requestErrors {
+		errors[request] = count
+	}
+	return requests, errors
 }
 
-func (c *Client) DiskMetrics() (map[string]float64, error) {
-	log.Infof("[Client] Collect Disk metrics")
-	return c.collect(c.Plugins["disk"])
+// CounterWraps returns the number of times a 32 bits counter walked by the
+// plugins decreased: it wrapped, or the Diskstation rebooted.
+func (c *Client) CounterWraps() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counterWraps
 }
 
-func (c *Client) LoadMetrics() (map[string]float64, error) {
-	log.Infof("[Client] Collect Load metrics")
-	return c.collect(c.Plugins["load"])
+// Reconnects returns the number of times the SNMP connection was reopened
+// after a failure.
+func (c *Client) Reconnects() uint64 {
+	return atomic.LoadUint64(&c.reconnects)
 }
 
-func (c *Client) CPUMetrics() (map[string]float64, error) {
-	log.Infof("[Client] Collect Cpu metrics")
-	return c.collect(c.Plugins["cpu"])
+// WalkAnomalies returns the number of variables skipped by the walks as
+// their OID didn't increase.
+func (c *Client) WalkAnomalies() uint64 {
+	return atomic.LoadUint64(&c.walkAnomalies)
 }
 
-func (c *Client) MemoryMetrics() (map[string]float64, error) {
-	log.Infof("[Client] Collect Memory metrics")
-	return c.collect(c.Plugins["mem"])
+// DecodeErrors returns the number of SNMP responses which couldn't be
+// decoded, and were ignored.
+func (c *Client) DecodeErrors() uint64 {
+	return atomic.LoadUint64(&c.decodeErrors)
 }
 
-func (c *Client) NetworkMetrics() (map[string]float64, error) {
-	log.Infof("[Client] Collect Network metrics")
-	return c.collect(c.Plugins["net"])
+// SNMPRetries returns the number of SNMP requests sent again by gosnmp, as
+// the previous attempt timed out, up to the SNMP Retries.
+func (c *Client) SNMPRetries() uint64 {
+	return atomic.LoadUint64(&c.retries)
 }
 
-func (c *Client) collect(plugin plugins.Plugin) (map[string]float64, error) {
-	metrics, err := plugin.Fetch(c.SNMP)
+// SkipNotIncreasing makes the walks skip the variables whose OID doesn't
+// increase, instead of failing: some agents return them in the middle of a
+// table.
+func (c *Client) SkipNotIncreasing() {
+	c.SNMP.OnWalkAnomaly = func(variable gosnmp.SnmpPDU) {
+		log.Warnf("[Client] Skip %s of %s: OID not increasing", variable.Name, c.Diskstation)
+		atomic.AddUint64(&c.walkAnomalies, 1)
+	}
+}
+
+// connect opens the connection of the session to the Diskstation, unless
+// it's already opened to its current address.
+func (c *Client) connect(s *session) error {
+	c.mu.Lock()
+	err := c.resolve()
+	target := c.SNMP.Target
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if s.target != target {
+		s.Close()
+		s.snmp.Target = target
+		s.target = target
+	}
+	if err := s.Connect(); err != nil {
+		return err
+	}
+	c.restoreEngine(s.snmp)
+	return nil
+}
+
+// resolve looks up the IP of the Diskstation if it's given by host name. It's
+// done once, or every ResolveInterval; the connections are reopened if the IP
+// changed. mu must be held.
+func (c *Client) resolve() error {
+	if net.ParseIP(c.host) != nil {
+		return nil
+	}
+	if !c.resolved.IsZero() && (c.ResolveInterval == 0 || time.Since(c.resolved) < c.ResolveInterval) {
+		return nil
+	}
+	addrs, err := net.LookupHost(c.host)
+	if err != nil || len(addrs) == 0 {
+		if c.resolved.IsZero() {
+			return fmt.Errorf("Can't resolve Diskstation %s: %v", c.host, err)
+		}
+		// Keep the last known address until the DNS is back
+		log.Warnf("[Client] Can't resolve Diskstation %s, still using %s: %v", c.host, c.SNMP.Target, err)
+		c.resolved = time.Now()
+		return nil
+	}
+	if !c.resolved.IsZero() && addrs[0] != c.SNMP.Target {
+		log.Infof("[Client] Diskstation %s moved from %s to %s", c.host, c.SNMP.Target, addrs[0])
+	}
+	c.SNMP.Target = addrs[0]
+	c.resolved = time.Now()
+	return nil
+}
+
+func (c *Client) reconnect(s *session) error {
+	atomic.AddUint64(&c.reconnects, 1)
+	s.Close()
+	return c.connect(s)
+}
+
+func (c *Client) SystemMetrics(ctx context.Context) (*plugins.SystemMetrics, error) {
+	return collectMetrics[plugins.SystemMetrics](ctx, c, "system")
+}
+
+func (c *Client) DiskMetrics(ctx context.Context) (*plugins.DiskMetrics, error) {
+	return collectMetrics[plugins.DiskMetrics](ctx, c, "disk")
+}
+
+func (c *Client) DiskIOMetrics(ctx context.Context) (*plugins.DiskIOMetrics, error) {
+	return collectMetrics[plugins.DiskIOMetrics](ctx, c, "diskio")
+}
+
+func (c *Client) ServiceMetrics(ctx context.Context) (*plugins.ServiceMetrics, error) {
+	return collectMetrics[plugins.ServiceMetrics](ctx, c, "service")
+}
+
+func (c *Client) CustomMetrics(ctx context.Context) (*plugins.CustomMetrics, error) {
+	return collectMetrics[plugins.CustomMetrics](ctx, c, "custom")
+}
+
+func (c *Client) SpaceMetrics(ctx context.Context) (*plugins.SpaceMetrics, error) {
+	return collectMetrics[plugins.SpaceMetrics](ctx, c, "space")
+}
+
+func (c *Client) StorageMetrics(ctx context.Context) (*plugins.StorageMetrics, error) {
+	return collectMetrics[plugins.StorageMetrics](ctx, c, "storage")
+}
+
+func (c *Client) LoadMetrics(ctx context.Context) (*plugins.LoadMetrics, error) {
+	return collectMetrics[plugins.LoadMetrics](ctx, c, "load")
+}
+
+func (c *Client) CPUMetrics(ctx context.Context) (*plugins.CPUMetrics, error) {
+	return collectMetrics[plugins.CPUMetrics](ctx, c, "cpu")
+}
+
+func (c *Client) MemoryMetrics(ctx context.Context) (*plugins.MemoryMetrics, error) {
+	return collectMetrics[plugins.MemoryMetrics](ctx, c, "mem")
+}
+
+func (c *Client) NetworkMetrics(ctx context.Context) (*plugins.NetworkMetrics, error) {
+	return collectMetrics[plugins.NetworkMetrics](ctx, c, "net")
+}
+
+// fetcher runs a plugin: fetch retrieves its metrics and parse, if set,
+// returns them from the prefetched values, or nil.
+type fetcher struct {
+	fetch func(ctx context.Context, snmp plugins.SNMPGetter) (interface{}, error)
+	parse func(variables map[string]gosnmp.SnmpPDU) interface{}
+}
+
+// collectMetrics returns the metrics of the plugin, a Fetcher of *M. It fails
+// if the plugin was replaced by one fetching other metrics.
+func collectMetrics[M any](ctx context.Context, c *Client, name string) (*M, error) {
+	log.Debugf("[Client] Collect %s metrics", name)
+	plugin, ok := c.Plugins[name].(plugins.Fetcher[*M])
+	if !ok {
+		return nil, fmt.Errorf("Can't collect %s metrics: unexpected plugin %T", name, c.Plugins[name])
+	}
+	f := fetcher{
+		fetch: func(ctx context.Context, snmp plugins.SNMPGetter) (interface{}, error) {
+			metrics, err := plugin.Fetch(ctx, snmp)
+			if err != nil {
+				return nil, err
+			}
+			return metrics, nil
+		},
+	}
+	if parser, ok := plugin.(plugins.Parser[*M]); ok {
+		f.parse = func(variables map[string]gosnmp.SnmpPDU) interface{} {
+			if metrics := parser.Parse(variables); metrics != nil {
+				return metrics
+			}
+			return nil
+		}
+	}
+	metrics, err := c.collect(ctx, name, f)
 	if err != nil {
 		return nil, err
 	}
+	// Set by the fetcher above, as the collections are by plugin name
+	return metrics.(*M), nil
+}
+
+// collectOnce fetches the metrics of the plugin. If it fails, the last
+// metrics fetched are returned instead, unless they are older than
+// CacheMaxAge.
+func (c *Client) collectOnce(ctx context.Context, name string, f fetcher) (interface{}, error) {
+	var requestErr error
+	ctx = plugins.WithRequestRecorder(ctx, func(request string, err error) {
+		c.recordRequest(name, request, err)
+		requestErr = err
+	})
+	ctx = plugins.WithCounterRecorder(ctx, c.recordCounter)
+	var metrics interface{}
+	var err error
+	start := time.Now()
+	if f.parse != nil && prefetched(ctx) != nil {
+		metrics = f.parse(prefetched(ctx))
+	}
+	fetched := false
+	if metrics == nil {
+		if err = c.Down(); err == nil {
+			metrics, err = c.fetchWithRetries(ctx, f, &requestErr)
+			fetched = true
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if fetched {
+		c.recordAgent(err)
+	}
+	c.durations[name] = time.Since(start)
+	if err != nil {
+		cached, ok := c.cache[name]
+		if !ok || time.Since(cached.fetched) > c.CacheMaxAge {
+			c.stale[name] = false
+			return nil, err
+		}
+		log.Warnf("[Client] Serving %s metrics fetched at %s: %v", name, cached.fetched, err)
+		c.stale[name] = true
+		return cached.metrics, nil
+	}
+	if c.CacheMaxAge > 0 {
+		c.cache[name] = cachedMetrics{metrics: metrics, fetched: time.Now()}
+	}
+	c.stale[name] = false
 	return metrics, nil
 }
 
-// // Collect will retrieve SNMP informations from the Diskstation
-// func (c *Client) Collect() {
-// 	for now := range time.Tick(c.Interval) {
-// 		c.SNMP.Connect()
-// 		defer c.SNMP.Conn.Close()
-// 		for _, plugin := range c.Plugins {
-// 			data, err := plugin.Fetch(c.SNMP)
-// 			if err != nil {
-// 				log.Errorf("[Client] Error retrieving SNMP values: %v", err)
-// 			} else {
-// 				for key, value := range data {
-// 					metric := fmt.Sprintf("%s %v %d\n\r", key, value, now.Unix())
-// 				}
-// 			}
-// 		}
-
-// 	}
-// }
+// recordCounter counts a wrap when the value of the 32 bits counter is lower
+// than the last one.
+func (c *Client) recordCounter(oid string, value float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if previous, ok := c.counters[oid]; ok && value < previous {
+		log.Debugf("[Client] Counter %s wrapped: %v < %v", oid, value, previous)
+		c.counterWraps++
+	}
+	c.counters[oid] = value
+}
+
+// fetchWithRetries runs the plugin, retrying it with an exponential backoff
+// on a new connection while its last SNMP request failed on a transient
+// error. requestErr is set by the request recorder of the context.
+func (c *Client) fetchWithRetries(ctx context.Context, f fetcher, requestErr *error) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	backoff := retryBackoff
+	for retry := 0; ; retry++ {
+		*requestErr = nil
+		metrics, err := c.attempt(ctx, f, retry > 0)
+		if err == nil {
+			return metrics, nil
+		}
+		if retry >= c.FetchRetries || ctx.Err() != nil || !isTransient(*requestErr) {
+			return nil, err
+		}
+		// The connection may be dead (Diskstation rebooted, network
+		// change, ...) or the Diskstation overloaded, so wait and reopen
+		// it before giving the plugin another try. The session is back in
+		// the pool meanwhile, for the other plugins and Ping.
+		log.Debugf("[Client] SNMP request failed, retrying in %s: %v", backoff, err)
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// attempt runs the plugin on a session of the pool. Its connection is reopened
+// first on a retry.
+func (c *Client) attempt(ctx context.Context, f fetcher, retry bool) (interface{}, error) {
+	s, err := c.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(s)
+	if retry {
+		err = c.reconnect(s)
+	} else {
+		err = c.connect(s)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.fetch(ctx, s, f)
+}
+
+// isTransient returns whether a SNMP request may succeed if it's sent again:
+// it timed out or the network failed. Other errors (invalid OID, ...) are
+// permanent.
+func isTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	// gosnmp doesn't keep the type of the network errors
+	for _, prefix := range []string{gosnmp.ErrTimeout, gosnmp.ErrReadUDP, gosnmp.ErrReadTCP} {
+		if strings.HasPrefix(err.Error(), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// fetch runs the plugin on the connection of the session, unless it's aborted
+// when the context is done.
+func (c *Client) fetch(ctx context.Context, s *session, f fetcher) (interface{}, error) {
+	var metrics interface{}
+	err := c.abortable(ctx, s, func() error {
+		var err error
+		metrics, err = f.fetch(ctx, batchedSession{Session: s.Session, client: c})
+		return err
+	})
+	return metrics, err
+}
+
+// abortable runs the SNMP requests of f on the connection of the session.
+// The pending request is aborted as soon as the context is done.
+func (c *Client) abortable(ctx context.Context, s *session, f func() error) error {
+	s.snmp.Context = ctx
+	defer func() {
+		s.snmp.Context = nil
+	}()
+	err := f()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
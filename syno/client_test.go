@@ -0,0 +1,898 @@
+// Copyright (C) 2016 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syno
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/soniah/gosnmp"
+
+	"github.com/nlamirault/syno_exporter/config"
+	"github.com/nlamirault/syno_exporter/syno/plugins"
+)
+
+func TestNewClientWithIPv6Target(t *testing.T) {
+	for _, tc := range []struct {
+		diskstation string
+		target      string
+		port        uint16
+	}{
+		{"::1", "::1", 161},
+		{"[::1]", "::1", 161},
+		{"[fd00::11]:1161", "fd00::11", 1161},
+		{"192.168.1.11", "192.168.1.11", 161},
+		{"192.168.1.11:1161", "192.168.1.11", 1161},
+		{"diskstation.local", "diskstation.local", 161},
+	} {
+		client, err := NewClient(tc.diskstation, DefaultInterval)
+		if err != nil {
+			t.Fatalf("Can't create client for %s: %s", tc.diskstation, err)
+		}
+		if client.SNMP.Target != tc.target || client.SNMP.Port != tc.port {
+			t.Fatalf("Invalid SNMP target for %s: %s port %d", tc.diskstation, client.SNMP.Target, client.SNMP.Port)
+		}
+		if client.Diskstation != tc.diskstation {
+			t.Fatalf("Invalid Diskstation: %s", client.Diskstation)
+		}
+	}
+}
+
+func TestNewClientWithInvalidPort(t *testing.T) {
+	for _, diskstation := range []string{"[::1]:snmp", "192.168.1.11:99999"} {
+		if _, err := NewClient(diskstation, DefaultInterval); err == nil {
+			t.Fatalf("No error for %s", diskstation)
+		}
+	}
+}
+
+func TestNewClientWithoutDiskstation(t *testing.T) {
+	if _, err := NewClient("", DefaultInterval); err == nil {
+		t.Fatalf("No error for an empty Diskstation")
+	}
+}
+
+func TestNewClientWithMalformedDiskstation(t *testing.T) {
+	for _, diskstation := range []string{
+		"192.168.1.300", "192.168.1", "::1::2", "[::1", "disk station", "-diskstation.local", ":161", "[]",
+	} {
+		if _, err := NewClient(diskstation, DefaultInterval); err == nil {
+			t.Fatalf("No error for %s", diskstation)
+		}
+	}
+}
+
+func TestNewClientWithInvalidInterval(t *testing.T) {
+	for _, interval := range []time.Duration{0, -time.Second} {
+		if _, err := NewClient("192.168.1.11", interval); err == nil {
+			t.Fatalf("No error for interval %s", interval)
+		}
+	}
+}
+
+func TestNewClientFromConfigWithCustomOIDs(t *testing.T) {
+	client, err := NewClientFromConfig(&config.Target{
+		Diskstation: "192.168.1.11",
+		Plugins:     []string{"system"},
+		CustomOIDs:  map[string]string{"mem_total": ".1.3.6.1.4.1.2021.4.5.0"},
+	})
+	if err != nil {
+		t.Fatalf("Can't create client: %s", err)
+	}
+	if names := client.PluginNames(); len(names) != 2 || names[0] != "custom" {
+		t.Fatalf("Invalid plugins: %v", names)
+	}
+	for _, name := range []string{"mem-total", "1mem", ""} {
+		if _, err := NewClientFromConfig(&config.Target{
+			Diskstation: "192.168.1.11",
+			CustomOIDs:  map[string]string{name: ".1.3.6.1.4.1.2021.4.5.0"},
+		}); err == nil {
+			t.Fatalf("No error for custom OID name %q", name)
+		}
+	}
+}
+
+func TestNewClientFromConfigWithOIDBases(t *testing.T) {
+	client, err := NewClientFromConfig(&config.Target{
+		Diskstation: "192.168.1.11",
+		OIDBases:    map[string]string{"mem": ".1.3.6.1.4.1.2021.99"},
+	})
+	if err != nil {
+		t.Fatalf("Can't create client: %s", err)
+	}
+	oids := client.Plugins["mem"].(plugins.ScalarPlugin).OIDs()
+	sort.Strings(oids)
+	if oids[0] != ".1.3.6.1.4.1.2021.99.11.0" {
+		t.Fatalf("Invalid OIDs: %v", oids)
+	}
+	for name, base := range map[string]string{
+		"net":     ".1.3.6.1.2.1.2",
+		"mem":     "1.3.6.1.4.1.2021.4",
+		"unknown": ".1.3.6.1.4.1.2021.4",
+	} {
+		if _, err := NewClientFromConfig(&config.Target{
+			Diskstation: "192.168.1.11",
+			OIDBases:    map[string]string{name: base},
+		}); err == nil {
+			t.Fatalf("No error for the OID base %s of %s", base, name)
+		}
+	}
+}
+
+// newTestClient returns a client of the fake agent
+func newTestClient(t *testing.T, agent *net.UDPConn) *Client {
+	client, err := NewClient(fmt.Sprintf("127.0.0.1:%d", agent.LocalAddr().(*net.UDPAddr).Port), DefaultInterval)
+	if err != nil {
+		t.Fatalf("Can't create client: %s", err)
+	}
+	client.SNMP.Timeout = time.Second
+	return client
+}
+
+func TestSet(t *testing.T) {
+	agent := echoAgent(t)
+	defer agent.Close()
+	client := newTestClient(t, agent)
+	defer client.Close()
+
+	for _, value := range []interface{}{1, "DiskStation"} {
+		if err := client.Set(".1.3.6.1.2.1.1.5.0", value); err != nil {
+			t.Fatalf("Can't set %v: %s", value, err)
+		}
+	}
+	if err := client.Set(".1.3.6.1.2.1.1.5.0", 1.5); err == nil {
+		t.Fatalf("No error for a float value")
+	}
+	requests, _ := client.Requests()
+	if count := requests[SNMPRequest{Plugin: "set", Type: "set"}]; count != 2 {
+		t.Fatalf("Invalid number of Set requests: %d", count)
+	}
+}
+
+func TestSNMPRetries(t *testing.T) {
+	// The first request is lost, the next ones are echoed
+	agent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("Can't listen: %s", err)
+	}
+	defer agent.Close()
+	go func() {
+		buf := make([]byte, 65535)
+		for lost := false; ; lost = true {
+			n, addr, err := agent.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if lost {
+				agent.WriteToUDP(fakeResponse(buf[:n], func(requestID []byte) []byte { return requestID }, gosnmp.NoError), addr)
+			}
+		}
+	}()
+	client := newTestClient(t, agent)
+	defer client.Close()
+	client.SNMP.Retries = 2
+
+	if err := client.Set(".1.3.6.1.2.1.1.5.0", 1); err != nil {
+		t.Fatalf("Can't set after a lost request: %s", err)
+	}
+	if retries := client.SNMPRetries(); retries != 1 {
+		t.Fatalf("Invalid number of retries: %d", retries)
+	}
+}
+
+func TestSetRejected(t *testing.T) {
+	agent := fakeAgent(t, func(requestID []byte) []byte { return requestID }, gosnmp.NotWritable)
+	defer agent.Close()
+	client := newTestClient(t, agent)
+	defer client.Close()
+
+	err := client.Set(".1.3.6.1.2.1.1.1.0", "DiskStation")
+	setErr, ok := err.(*SetError)
+	if !ok {
+		t.Fatalf("Invalid error: %v", err)
+	}
+	if setErr.Status != gosnmp.NotWritable || setErr.OID != ".1.3.6.1.2.1.1.1.0" {
+		t.Fatalf("Invalid error status: %v", setErr)
+	}
+}
+
+// tooBigSession answers tooBig to the Get requests of more than maxOids OIDs
+type tooBigSession struct {
+	Session
+	maxOids int
+	tooBig  *int
+}
+
+func (s tooBigSession) Get(oids []string) (*gosnmp.SnmpPacket, error) {
+	if len(oids) > s.maxOids {
+		*s.tooBig++
+		return &gosnmp.SnmpPacket{Error: gosnmp.TooBig}, nil
+	}
+	result := &gosnmp.SnmpPacket{}
+	for _, oid := range oids {
+		result.Variables = append(result.Variables, gosnmp.SnmpPDU{Name: oid, Type: gosnmp.Integer, Value: 1})
+	}
+	return result, nil
+}
+
+func TestGetWithTooBigResponses(t *testing.T) {
+	client, err := NewClient("127.0.0.1", DefaultInterval)
+	if err != nil {
+		t.Fatalf("Can't create client: %s", err)
+	}
+	tooBig := 0
+	client.NewSession = func(snmp *gosnmp.GoSNMP) Session {
+		return tooBigSession{Session: NewSession(snmp), maxOids: 3, tooBig: &tooBig}
+	}
+	if err := client.EnablePlugins([]string{"system"}); err != nil {
+		t.Fatalf("Can't enable plugins: %s", err)
+	}
+
+	metrics, err := client.SystemMetrics(context.Background())
+	if err != nil {
+		t.Fatalf("Can't collect the system metrics: %s", err)
+	}
+	// All the 7 OIDs were answered
+	if metrics.Status == nil || metrics.UpgradeAvailable == nil || metrics.Uptime == nil || len(metrics.Fans) != 1 {
+		t.Fatalf("Invalid system metrics: %+v", metrics)
+	}
+	if client.batchSize == 0 || client.batchSize > 3 {
+		t.Fatalf("Invalid batch size: %d", client.batchSize)
+	}
+
+	// The next collections use the smaller batches right away
+	tooBig = 0
+	if _, err := client.SystemMetrics(context.Background()); err != nil {
+		t.Fatalf("Can't collect the system metrics again: %s", err)
+	}
+	if tooBig != 0 {
+		t.Fatalf("%d tooBig responses after the batch size converged", tooBig)
+	}
+}
+
+// statusSession answers noSuchName to the Get requests of the missing OID
+type statusSession struct {
+	Session
+	missing string
+}
+
+func (s statusSession) Get(oids []string) (*gosnmp.SnmpPacket, error) {
+	result := &gosnmp.SnmpPacket{}
+	for i, oid := range oids {
+		if oid == s.missing {
+			result.Error, result.ErrorIndex = gosnmp.NoSuchName, uint8(i+1)
+		}
+		result.Variables = append(result.Variables, gosnmp.SnmpPDU{Name: oid, Type: gosnmp.Integer, Value: 1})
+	}
+	return result, nil
+}
+
+// countingSession answers the Get requests with the OIDs, and counts them
+type countingSession struct {
+	Session
+	gets *int
+}
+
+func (s countingSession) Get(oids []string) (*gosnmp.SnmpPacket, error) {
+	*s.gets++
+	result := &gosnmp.SnmpPacket{}
+	for _, oid := range oids {
+		result.Variables = append(result.Variables, gosnmp.SnmpPDU{Name: oid, Type: gosnmp.Integer, Value: 1})
+	}
+	return result, nil
+}
+
+func TestGetInBatches(t *testing.T) {
+	client, err := NewClient("127.0.0.1", DefaultInterval)
+	if err != nil {
+		t.Fatalf("Can't create client: %s", err)
+	}
+	client.SNMP.MaxOids = 2
+	oids := []string{".1.1.0", ".1.2.0", ".1.3.0", ".1.4.0", ".1.5.0"}
+
+	gets := 0
+	result, err := client.batchGet(countingSession{gets: &gets}, oids)
+	if err != nil {
+		t.Fatalf("Can't get the OIDs: %s", err)
+	}
+	if gets != 3 {
+		t.Fatalf("%d Get requests for %d OIDs by %d", gets, len(oids), client.SNMP.MaxOids)
+	}
+	if len(result.Variables) != len(oids) {
+		t.Fatalf("Invalid variables: %v", result.Variables)
+	}
+	for i, variable := range result.Variables {
+		if variable.Name != oids[i] {
+			t.Fatalf("Invalid variable %d: %s instead of %s", i, variable.Name, oids[i])
+		}
+	}
+}
+
+func TestGetWithoutOIDs(t *testing.T) {
+	client, err := NewClient("127.0.0.1", DefaultInterval)
+	if err != nil {
+		t.Fatalf("Can't create client: %s", err)
+	}
+	gets := 0
+	result, err := client.batchGet(countingSession{gets: &gets}, nil)
+	if err != nil {
+		t.Fatalf("Can't get no OIDs: %s", err)
+	}
+	if result == nil || len(result.Variables) != 0 || gets != 0 {
+		t.Fatalf("Invalid result: %v after %d Get requests", result, gets)
+	}
+}
+
+func TestGetWithErrorStatusInLaterBatch(t *testing.T) {
+	client, err := NewClient("127.0.0.1", DefaultInterval)
+	if err != nil {
+		t.Fatalf("Can't create client: %s", err)
+	}
+	client.SNMP.MaxOids = 2
+	oids := []string{".1.1.0", ".1.2.0", ".1.3.0", ".1.4.0", ".1.5.0"}
+
+	_, err = client.batchGet(statusSession{missing: ".1.4.0"}, oids)
+	status, ok := err.(*plugins.StatusError)
+	if !ok {
+		t.Fatalf("Invalid error: %v", err)
+	}
+	// The 2nd OID of the 2nd batch
+	if status.Status != gosnmp.NoSuchName || status.Index != 4 {
+		t.Fatalf("Invalid error status: %+v", status)
+	}
+}
+
+func TestAgentDown(t *testing.T) {
+	// Nothing listens on the port: the requests are refused, as when SNMP
+	// is disabled in DSM.
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("Can't listen: %s", err)
+	}
+	diskstation := conn.LocalAddr().String()
+	conn.Close()
+
+	client, err := NewClient(diskstation, DefaultInterval)
+	if err != nil {
+		t.Fatalf("Can't create client: %s", err)
+	}
+	defer client.Close()
+	if err := client.EnablePlugins([]string{"service"}); err != nil {
+		t.Fatalf("Can't enable plugins: %s", err)
+	}
+	if _, err := client.ServiceMetrics(context.Background()); err == nil {
+		t.Fatal("No error from a disabled agent")
+	}
+	if err := client.Down(); err == nil {
+		t.Fatal("Agent refusing the requests not down")
+	}
+
+	requests, _ := client.Requests()
+	if _, err := client.ServiceMetrics(context.Background()); err == nil {
+		t.Fatal("No error from a down agent")
+	}
+	if again, _ := client.Requests(); fmt.Sprint(again) != fmt.Sprint(requests) {
+		t.Fatalf("Requests sent to a down agent: %v", again)
+	}
+}
+
+// engineAgent is a SNMPv3 agent without authentication answering sysDescr.
+// It reports its engine to the discovery requests, and the next request is
+// reported out of its time window when notInTimeWindow is set.
+type engineAgent struct {
+	conn *net.UDPConn
+
+	mu              sync.Mutex
+	boots           uint32
+	time            uint32
+	notInTimeWindow bool
+	discoveries     int
+	// requestBoots and requestTime are the engine boots and time of the
+	// last request
+	requestBoots uint32
+	requestTime  uint32
+}
+
+// berUint encodes an unsigned integer as the value of a BER integer
+func berUint(n uint32) []byte {
+	value := []byte{byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}
+	for len(value) > 1 && value[0] == 0 && value[1] < 0x80 {
+		value = value[1:]
+	}
+	if value[0] >= 0x80 {
+		value = append([]byte{0}, value...)
+	}
+	return value
+}
+
+// parseUint decodes the value of a BER integer
+func parseUint(value []byte) (n uint32) {
+	for _, b := range value {
+		n = n<<8 | uint32(b)
+	}
+	return n
+}
+
+func newEngineAgent(t *testing.T) *engineAgent {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("Can't listen: %s", err)
+	}
+	agent := &engineAgent{conn: conn, boots: 1, time: 100}
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(agent.respond(buf[:n]), addr)
+		}
+	}()
+	return agent
+}
+
+func (a *engineAgent) respond(request []byte) []byte {
+	_, message, _ := readTLV(request)
+	_, version, rest := readTLV(message)
+	_, header, rest := readTLV(rest)
+	_, securityParameters, rest := readTLV(rest)
+	_, scopedPDU, _ := readTLV(rest)
+	_, msgID, _ := readTLV(header)
+	_, usm, _ := readTLV(securityParameters)
+	_, engineID, rest := readTLV(usm)
+	_, boots, rest := readTLV(rest)
+	_, engineTime, _ := readTLV(rest)
+	_, _, rest = readTLV(scopedPDU)
+	_, _, rest = readTLV(rest)
+	_, pdu, _ := readTLV(rest)
+	_, requestID, _ := readTLV(pdu)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	pduType := byte(gosnmp.GetResponse)
+	// sysDescr.0 = DSM
+	varbind := ber(0x30,
+		ber(gosnmp.ObjectIdentifier, []byte{0x2b, 6, 1, 2, 1, 1, 1, 0}),
+		ber(gosnmp.OctetString, []byte("DSM")))
+	switch {
+	case len(engineID) == 0:
+		a.discoveries++
+		pduType = byte(gosnmp.Report)
+		// usmStatsUnknownEngineIDs.0
+		varbind = ber(0x30,
+			ber(gosnmp.ObjectIdentifier, []byte{0x2b, 6, 1, 6, 3, 15, 1, 1, 4, 0}),
+			ber(gosnmp.Counter32, []byte{1}))
+	case a.notInTimeWindow:
+		a.notInTimeWindow = false
+		pduType = byte(gosnmp.Report)
+		// usmStatsNotInTimeWindows.0
+		varbind = ber(0x30,
+			ber(gosnmp.ObjectIdentifier, []byte{0x2b, 6, 1, 6, 3, 15, 1, 1, 2, 0}),
+			ber(gosnmp.Counter32, []byte{1}))
+	default:
+		a.requestBoots = parseUint(boots)
+		a.requestTime = parseUint(engineTime)
+	}
+	return ber(0x30,
+		ber(gosnmp.Integer, version),
+		ber(0x30,
+			ber(gosnmp.Integer, msgID),
+			ber(gosnmp.Integer, []byte{0x05, 0xdc}),
+			ber(gosnmp.OctetString, []byte{0}),
+			ber(gosnmp.Integer, []byte{byte(gosnmp.UserSecurityModel)})),
+		ber(gosnmp.OctetString, ber(0x30,
+			ber(gosnmp.OctetString, []byte(testEngineID)),
+			ber(gosnmp.Integer, berUint(a.boots)),
+			ber(gosnmp.Integer, berUint(a.time)),
+			ber(gosnmp.OctetString, nil),
+			ber(gosnmp.OctetString, nil),
+			ber(gosnmp.OctetString, nil))),
+		ber(0x30,
+			ber(gosnmp.OctetString, []byte(testEngineID)),
+			ber(gosnmp.OctetString, nil),
+			ber(pduType,
+				ber(gosnmp.Integer, requestID),
+				ber(gosnmp.Integer, []byte{0}),
+				ber(gosnmp.Integer, []byte{0}),
+				ber(0x30, varbind))))
+}
+
+func TestSNMPv3EngineCache(t *testing.T) {
+	agent := newEngineAgent(t)
+	defer agent.conn.Close()
+	client := newTestClient(t, agent.conn)
+	defer client.Close()
+	client.SNMP.Version = gosnmp.Version3
+	if err := setSecurityParameters(client.SNMP, config.V3{Username: "monitoring"}); err != nil {
+		t.Fatalf("Can't set the security parameters: %s", err)
+	}
+	ping := func() (discoveries int, boots uint32, engineTime uint32) {
+		if err := client.Ping(); err != nil {
+			t.Fatalf("Can't ping: %s", err)
+		}
+		agent.mu.Lock()
+		defer agent.mu.Unlock()
+		return agent.discoveries, agent.requestBoots, agent.requestTime
+	}
+
+	// The engine is discovered once, and reused after a reconnection
+	ping()
+	client.Close()
+	if discoveries, _, _ := ping(); discoveries != 1 {
+		t.Fatalf("Engine discovered %d times", discoveries)
+	}
+
+	// The engine time is advanced since it was received
+	client.engine.synced = client.engine.synced.Add(-200 * time.Second)
+	if _, _, engineTime := ping(); engineTime < 300 {
+		t.Fatalf("Engine time not advanced: %d", engineTime)
+	}
+
+	// The engine rebooted: its boots and time are the ones of the report
+	agent.mu.Lock()
+	agent.boots, agent.time, agent.notInTimeWindow = 2, 10, true
+	agent.mu.Unlock()
+	if discoveries, boots, _ := ping(); discoveries != 1 || boots != 2 {
+		t.Fatalf("Invalid request after the reboot: %d discoveries, %d boots", discoveries, boots)
+	}
+	if client.engine.boots != 2 || client.engine.time != 10 {
+		t.Fatalf("Cached engine not invalidated: %+v", client.engine)
+	}
+	if _, boots, engineTime := ping(); boots != 2 || engineTime < 10 || engineTime > 20 {
+		t.Fatalf("Invalid engine in the next request: %d boots, time %d", boots, engineTime)
+	}
+}
+
+func TestUnexpectedPlugin(t *testing.T) {
+	client, err := NewClient("127.0.0.1", DefaultInterval)
+	if err != nil {
+		t.Fatalf("Can't create client: %s", err)
+	}
+	client.Plugins["service"] = plugins.SystemPlugin{}
+	if _, err := client.ServiceMetrics(context.Background()); err == nil || !strings.Contains(err.Error(), "unexpected plugin") {
+		t.Fatalf("Service metrics collected by the system plugin: %v", err)
+	}
+}
+
+// blockingPlugin counts its fetches, which signal they started and wait to
+// be released
+type blockingPlugin struct {
+	mu      *sync.Mutex
+	fetches *int
+	started chan struct{}
+	release chan struct{}
+}
+
+func (p blockingPlugin) Fetch(ctx context.Context, snmp plugins.SNMPGetter) (*plugins.ServiceMetrics, error) {
+	p.mu.Lock()
+	*p.fetches++
+	p.mu.Unlock()
+	select {
+	case p.started <- struct{}{}:
+	default:
+	}
+	<-p.release
+	return &plugins.ServiceMetrics{}, nil
+}
+
+// waitingContext signals when a scrape waits for its end, i.e. for the
+// collection in progress
+type waitingContext struct {
+	context.Context
+	waiting chan<- struct{}
+}
+
+func (ctx waitingContext) Done() <-chan struct{} {
+	ctx.waiting <- struct{}{}
+	return ctx.Context.Done()
+}
+
+func TestConcurrentCollects(t *testing.T) {
+	client, err := NewClient("127.0.0.1", DefaultInterval)
+	if err != nil {
+		t.Fatalf("Can't create client: %s", err)
+	}
+	defer client.Close()
+	fetches := 0
+	plugin := blockingPlugin{
+		mu:      &sync.Mutex{},
+		fetches: &fetches,
+		started: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+	client.Plugins = map[string]plugins.Plugin{"service": plugin}
+
+	const scrapes = 5
+	var wg sync.WaitGroup
+	results := make(chan *plugins.ServiceMetrics, scrapes)
+	scrape := func(ctx context.Context) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			metrics, err := client.ServiceMetrics(ctx)
+			if err != nil {
+				t.Errorf("Can't collect the service metrics: %s", err)
+			}
+			results <- metrics
+		}()
+	}
+	// The other scrapes start while the first one fetches the metrics, and
+	// it's released once they all wait for it
+	scrape(context.Background())
+	<-plugin.started
+	waiting := make(chan struct{}, scrapes)
+	for i := 1; i < scrapes; i++ {
+		scrape(waitingContext{context.Background(), waiting})
+	}
+	for i := 1; i < scrapes; i++ {
+		select {
+		case <-waiting:
+		case <-time.After(time.Second):
+			close(plugin.release)
+			t.Fatalf("%d scrapes wait for the collection in progress", i-1)
+		}
+	}
+	close(plugin.release)
+	wg.Wait()
+	close(results)
+
+	if fetches != 1 {
+		t.Fatalf("%d fetches for %d concurrent scrapes", fetches, scrapes)
+	}
+	var shared *plugins.ServiceMetrics
+	for metrics := range results {
+		if shared == nil {
+			shared = metrics
+		}
+		if metrics != shared {
+			t.Fatalf("Scrapes didn't share the metrics: %p != %p", metrics, shared)
+		}
+	}
+}
+
+func TestCancelledLeaderCollect(t *testing.T) {
+	client, err := NewClient("127.0.0.1", DefaultInterval)
+	if err != nil {
+		t.Fatalf("Can't create client: %s", err)
+	}
+	defer client.Close()
+	fetches := 0
+	plugin := blockingPlugin{
+		mu:      &sync.Mutex{},
+		fetches: &fetches,
+		started: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+	defer close(plugin.release)
+	client.Plugins = map[string]plugins.Plugin{"service": plugin}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := make(chan error)
+	go func() {
+		_, err := client.ServiceMetrics(ctx)
+		leader <- err
+	}()
+	<-plugin.started
+	waiting := make(chan struct{}, 1)
+	waiter := make(chan error)
+	go func() {
+		metrics, err := client.ServiceMetrics(waitingContext{context.Background(), waiting})
+		if err == nil && metrics == nil {
+			err = fmt.Errorf("No metrics")
+		}
+		waiter <- err
+	}()
+	<-waiting
+
+	// The scrape which started the collection gives up, the other one still
+	// gets its result
+	cancel()
+	select {
+	case err := <-leader:
+		if err != context.Canceled {
+			t.Fatalf("Invalid error of the cancelled scrape: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("The cancelled scrape waits for the collection")
+	}
+	plugin.release <- struct{}{}
+	if err := <-waiter; err != nil {
+		t.Fatalf("Can't collect the service metrics: %s", err)
+	}
+	if fetches != 1 {
+		t.Fatalf("%d fetches for 2 concurrent scrapes", fetches)
+	}
+}
+
+// idleSession is a Session sending no request, told apart by its address
+type idleSession struct {
+	Session
+	id int
+}
+
+func (s *idleSession) Connect() error { return nil }
+
+func (s *idleSession) Close() error { return nil }
+
+// sessionPlugin records the sessions of its fetches, and how many run at the
+// same time. They signal they started and wait to be released.
+type sessionPlugin struct {
+	mu       *sync.Mutex
+	running  *int
+	peak     *int
+	sessions map[Session]bool
+	started  chan struct{}
+	release  chan struct{}
+}
+
+func (p sessionPlugin) Fetch(ctx context.Context, snmp plugins.SNMPGetter) (*plugins.ServiceMetrics, error) {
+	p.mu.Lock()
+	p.sessions[snmp.(batchedSession).Session] = true
+	*p.running++
+	if *p.running > *p.peak {
+		*p.peak = *p.running
+	}
+	p.mu.Unlock()
+	p.started <- struct{}{}
+	<-p.release
+	p.mu.Lock()
+	*p.running--
+	p.mu.Unlock()
+	return &plugins.ServiceMetrics{}, nil
+}
+
+func TestParallelPlugins(t *testing.T) {
+	client, err := NewClient("127.0.0.1", DefaultInterval)
+	if err != nil {
+		t.Fatalf("Can't create client: %s", err)
+	}
+	defer client.Close()
+	client.Concurrency = 3
+	opened := 0
+	client.NewSession = func(*gosnmp.GoSNMP) Session {
+		opened++
+		return &idleSession{id: opened}
+	}
+	running, peak := 0, 0
+	plugin := sessionPlugin{
+		mu:       &sync.Mutex{},
+		running:  &running,
+		peak:     &peak,
+		sessions: map[Session]bool{},
+		started:  make(chan struct{}, 5),
+		release:  make(chan struct{}),
+	}
+	client.Plugins = map[string]plugins.Plugin{}
+	for i := 0; i < 5; i++ {
+		client.Plugins[fmt.Sprintf("plugin%d", i)] = plugin
+	}
+
+	var wg sync.WaitGroup
+	for _, name := range client.PluginNames() {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			if _, err := collectMetrics[plugins.ServiceMetrics](context.Background(), client, name); err != nil {
+				t.Errorf("Can't collect the %s metrics: %s", name, err)
+			}
+		}(name)
+	}
+	// As many plugins as sessions run at the same time
+	for i := 0; i < client.Concurrency; i++ {
+		select {
+		case <-plugin.started:
+		case <-time.After(time.Second):
+			close(plugin.release)
+			t.Fatalf("%d plugins run at the same time", i)
+		}
+	}
+	close(plugin.release)
+	wg.Wait()
+
+	if opened != client.Concurrency {
+		t.Fatalf("%d sessions opened for a concurrency of %d", opened, client.Concurrency)
+	}
+	if peak != client.Concurrency {
+		t.Fatalf("%d plugins ran at the same time for a concurrency of %d", peak, client.Concurrency)
+	}
+	if len(plugin.sessions) != client.Concurrency {
+		t.Fatalf("Plugins ran on %d sessions instead of %d", len(plugin.sessions), client.Concurrency)
+	}
+}
+
+// backoffSession times out the first Get of the plugin. Its retry waits for
+// a Ping, which answers right away.
+type backoffSession struct {
+	idleSession
+	gets    *int
+	failed  chan struct{}
+	pinged  chan struct{}
+	blocked *bool
+}
+
+func (s *backoffSession) Get(oids []string) (*gosnmp.SnmpPacket, error) {
+	result := &gosnmp.SnmpPacket{}
+	if len(oids) == 1 && oids[0] == oidSysDescr {
+		result.Variables = []gosnmp.SnmpPDU{{Name: oidSysDescr, Type: gosnmp.OctetString, Value: []byte("Linux")}}
+		close(s.pinged)
+		return result, nil
+	}
+	*s.gets++
+	if *s.gets == 1 {
+		close(s.failed)
+		return nil, fmt.Errorf("%s", gosnmp.ErrTimeout)
+	}
+	select {
+	case <-s.pinged:
+	case <-time.After(time.Second):
+		*s.blocked = true
+	}
+	for _, oid := range oids {
+		result.Variables = append(result.Variables, gosnmp.SnmpPDU{Name: oid, Type: gosnmp.Integer, Value: 1})
+	}
+	return result, nil
+}
+
+func TestPingDuringRetryBackoff(t *testing.T) {
+	client, err := NewClient("127.0.0.1", DefaultInterval)
+	if err != nil {
+		t.Fatalf("Can't create client: %s", err)
+	}
+	defer client.Close()
+	client.Concurrency = 1
+	gets, blocked := 0, false
+	session := &backoffSession{
+		gets:    &gets,
+		failed:  make(chan struct{}),
+		pinged:  make(chan struct{}),
+		blocked: &blocked,
+	}
+	client.NewSession = func(*gosnmp.GoSNMP) Session {
+		return session
+	}
+	if err := client.EnablePlugins([]string{"system"}); err != nil {
+		t.Fatalf("Can't enable plugins: %s", err)
+	}
+
+	collected := make(chan error)
+	go func() {
+		_, err := client.SystemMetrics(context.Background())
+		collected <- err
+	}()
+	<-session.failed
+	// The stats and the only session are available while the plugin waits
+	// for its retry
+	client.Requests()
+	client.Stale("system")
+	if err := client.Ping(); err != nil {
+		t.Fatalf("Can't ping during the retry backoff: %s", err)
+	}
+	if err := <-collected; err != nil {
+		t.Fatalf("Can't collect the system metrics: %s", err)
+	}
+	if blocked {
+		t.Fatalf("Ping waited for the retry of the plugin")
+	}
+	if gets != 2 {
+		t.Fatalf("Invalid number of Get requests of the plugin: %d", gets)
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright (C) 2016 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syno
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/soniah/gosnmp"
+
+	"github.com/nlamirault/syno_exporter/config"
+	"github.com/nlamirault/syno_exporter/syno/plugins"
+)
+
+// metricNameRE matches the names of the custom OIDs, which are part of the
+// metric names.
+var metricNameRE = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+// oidRE matches the numeric OIDs, with their leading dot
+var oidRE = regexp.MustCompile(`^(\.[0-9]+)+$`)
+
+// NewClientFromConfig defines a new client for the Synology Diskstation
+// described by the target configuration
+func NewClientFromConfig(target *config.Target) (*Client, error) {
+	interval := target.Interval
+	if interval == 0 {
+		interval = DefaultInterval
+	}
+	client, err := NewClient(target.Diskstation, interval)
+	if err != nil {
+		return nil, err
+	}
+	client.ResolveInterval = target.ResolveInterval
+	if target.Community != "" {
+		client.SNMP.Community = target.Community
+	}
+	version, err := parseVersion(target.Version)
+	if err != nil {
+		return nil, err
+	}
+	client.SNMP.Version = version
+	switch target.Transport {
+	case "", "udp", "tcp":
+		client.SNMP.Transport = target.Transport
+	default:
+		return nil, fmt.Errorf("Invalid SNMP transport: %s", target.Transport)
+	}
+	if target.LocalAddress != "" {
+		if err := validateLocalAddress(target.LocalAddress); err != nil {
+			return nil, err
+		}
+		client.SNMP.LocalAddr = target.LocalAddress
+	}
+	if target.MaxRepetitions < 0 || target.MaxRepetitions > math.MaxUint8 {
+		return nil, fmt.Errorf("Invalid SNMP max repetitions: %d", target.MaxRepetitions)
+	}
+	client.SNMP.MaxRepetitions = uint8(target.MaxRepetitions)
+	if target.NonRepeaters < 0 || target.NonRepeaters > math.MaxUint8 {
+		return nil, fmt.Errorf("Invalid SNMP non repeaters: %d", target.NonRepeaters)
+	}
+	client.SNMP.NonRepeaters = target.NonRepeaters
+	if target.MaxOids < 0 {
+		return nil, fmt.Errorf("Invalid SNMP max OIDs: %d", target.MaxOids)
+	}
+	client.SNMP.MaxOids = target.MaxOids
+	if target.Retries < 0 {
+		return nil, fmt.Errorf("Invalid SNMP retries: %d", target.Retries)
+	}
+	client.SNMP.Retries = target.Retries
+	if target.SkipNotIncreasing {
+		client.SkipNotIncreasing()
+	}
+	if version == gosnmp.Version3 {
+		if err := setSecurityParameters(client.SNMP, target.V3); err != nil {
+			return nil, err
+		}
+	} else if target.V3.ContextName != "" || target.V3.ContextEngineID != "" {
+		return nil, fmt.Errorf("Invalid SNMPv3 context with SNMP version %s", version)
+	}
+	client.Plugins["system"] = plugins.SystemPlugin{FanSpeed: target.SystemFanSpeed}
+	client.Plugins["cpu"] = plugins.CPUPlugin{PerCore: target.CPUPerCore}
+	client.Plugins["net"] = plugins.NetworkPlugin{PerInterface: target.NetPerInterface}
+	for name, base := range target.OIDBases {
+		plugin, ok := client.Plugins[name].(plugins.Rebased)
+		if !ok {
+			return nil, fmt.Errorf("Invalid OID base of %s: the plugin has no base OID", name)
+		}
+		if !oidRE.MatchString(base) {
+			return nil, fmt.Errorf("Invalid OID base of %s: %s", name, base)
+		}
+		client.Plugins[name] = plugin.WithBase(base)
+	}
+	if len(target.Plugins) > 0 {
+		if err := client.EnablePlugins(target.Plugins); err != nil {
+			return nil, err
+		}
+	}
+	if len(target.CustomOIDs) > 0 {
+		for name := range target.CustomOIDs {
+			if !metricNameRE.MatchString(name) {
+				return nil, fmt.Errorf("Invalid custom OID name: %s", name)
+			}
+		}
+		client.Plugins["custom"] = plugins.CustomPlugin{OIDs: target.CustomOIDs}
+	}
+	return client, nil
+}
+
+// validateLocalAddress checks the local address of the SNMP requests is an
+// IP, optionally followed by a port
+func validateLocalAddress(address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host, port = address, "0"
+	}
+	if net.ParseIP(host) == nil {
+		return fmt.Errorf("Invalid SNMP local address: %s", address)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("Invalid SNMP local address port: %s", address)
+	}
+	return nil
+}
+
+func parseVersion(version string) (gosnmp.SnmpVersion, error) {
+	switch version {
+	case "", "1":
+		return gosnmp.Version1, nil
+	case "2c":
+		return gosnmp.Version2c, nil
+	case "3":
+		return gosnmp.Version3, nil
+	default:
+		return 0, fmt.Errorf("Invalid SNMP version: %s", version)
+	}
+}
+
+func setSecurityParameters(snmp *gosnmp.GoSNMP, v3 config.V3) error {
+	if v3.Username == "" {
+		return fmt.Errorf("Missing SNMPv3 username")
+	}
+	params := &gosnmp.UsmSecurityParameters{
+		UserName:                 v3.Username,
+		AuthenticationProtocol:   gosnmp.NoAuth,
+		PrivacyProtocol:          gosnmp.NoPriv,
+		AuthenticationPassphrase: v3.AuthPassword,
+		PrivacyPassphrase:        v3.PrivPassword,
+	}
+	flags := gosnmp.NoAuthNoPriv
+
+	switch strings.ToUpper(v3.AuthProtocol) {
+	case "":
+	case "MD5":
+		params.AuthenticationProtocol = gosnmp.MD5
+		flags = gosnmp.AuthNoPriv
+	case "SHA":
+		params.AuthenticationProtocol = gosnmp.SHA
+		flags = gosnmp.AuthNoPriv
+	case "SHA224":
+		params.AuthenticationProtocol = gosnmp.SHA224
+		flags = gosnmp.AuthNoPriv
+	case "SHA256":
+		params.AuthenticationProtocol = gosnmp.SHA256
+		flags = gosnmp.AuthNoPriv
+	case "SHA384":
+		params.AuthenticationProtocol = gosnmp.SHA384
+		flags = gosnmp.AuthNoPriv
+	case "SHA512":
+		params.AuthenticationProtocol = gosnmp.SHA512
+		flags = gosnmp.AuthNoPriv
+	default:
+		return fmt.Errorf("Invalid SNMPv3 authentication protocol: %s", v3.AuthProtocol)
+	}
+	if flags == gosnmp.AuthNoPriv && v3.AuthPassword == "" {
+		return fmt.Errorf("Missing SNMPv3 authentication password for %s", v3.AuthProtocol)
+	}
+
+	switch strings.ToUpper(v3.PrivProtocol) {
+	case "":
+	case "DES":
+		params.PrivacyProtocol = gosnmp.DES
+		flags = gosnmp.AuthPriv
+	case "AES":
+		params.PrivacyProtocol = gosnmp.AES
+		flags = gosnmp.AuthPriv
+	case "AES192":
+		params.PrivacyProtocol = gosnmp.AES192
+		flags = gosnmp.AuthPriv
+	case "AES256":
+		params.PrivacyProtocol = gosnmp.AES256
+		flags = gosnmp.AuthPriv
+	default:
+		return fmt.Errorf("Invalid SNMPv3 privacy protocol: %s", v3.PrivProtocol)
+	}
+	if flags == gosnmp.AuthPriv {
+		if params.AuthenticationProtocol == gosnmp.NoAuth {
+			return fmt.Errorf("SNMPv3 privacy protocol %s requires an authentication protocol", v3.PrivProtocol)
+		}
+		if v3.PrivPassword == "" {
+			return fmt.Errorf("Missing SNMPv3 privacy password for %s", v3.PrivProtocol)
+		}
+	}
+
+	engineID, err := hex.DecodeString(strings.TrimPrefix(strings.ToLower(v3.ContextEngineID), "0x"))
+	if err != nil {
+		return fmt.Errorf("Invalid SNMPv3 context engine ID %s: %s", v3.ContextEngineID, err)
+	}
+
+	snmp.SecurityModel = gosnmp.UserSecurityModel
+	snmp.MsgFlags = flags
+	snmp.SecurityParameters = params
+	snmp.ContextName = v3.ContextName
+	snmp.ContextEngineID = string(engineID)
+	return nil
+}
@@ -0,0 +1,101 @@
+// Copyright (C) 2016 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syno
+
+import (
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/soniah/gosnmp"
+)
+
+// usmStats counters of SNMP-USER-BASED-SM-MIB, reported by the SNMPv3 agent
+// when it rejects a request
+const (
+	oidUsmStatsNotInTimeWindows = ".1.3.6.1.6.3.15.1.1.2.0"
+	oidUsmStatsUnknownEngineIDs = ".1.3.6.1.6.3.15.1.1.4.0"
+	oidUsmStatsWrongDigests     = ".1.3.6.1.6.3.15.1.1.5.0"
+)
+
+// usmEngine is the SNMPv3 authoritative engine of the Diskstation, as
+// discovered by gosnmp or updated by its last response.
+type usmEngine struct {
+	id    string
+	boots uint32
+	time  uint32
+	// synced is when the engine time was received
+	synced time.Time
+}
+
+// storeEngine caches the engine of the security parameters of the last
+// response. Called by gosnmp.
+func (c *Client) storeEngine(params gosnmp.SnmpV3SecurityParameters) {
+	usm, ok := params.(*gosnmp.UsmSecurityParameters)
+	if !ok {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.engine = usmEngine{
+		id:     usm.AuthoritativeEngineID,
+		boots:  usm.AuthoritativeEngineBoots,
+		time:   usm.AuthoritativeEngineTime,
+		synced: time.Now(),
+	}
+}
+
+// engineReport invalidates the cached engine when the Diskstation rejects a
+// request because of it. Called by gosnmp.
+func (c *Client) engineReport(oid string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch oid {
+	case oidUsmStatsNotInTimeWindows:
+		// The engine rebooted: gosnmp sends the request again with the
+		// boots and time of the report, which are cached instead
+		log.Debugf("[Client] SNMPv3 request to %s out of the engine time window", c.Diskstation)
+		c.engine = usmEngine{}
+	case oidUsmStatsUnknownEngineIDs, oidUsmStatsWrongDigests:
+		// The engine ID changed, e.g. DSM was reinstalled: it's
+		// discovered again by the next collection
+		log.Infof("[Client] SNMPv3 engine of %s changed", c.Diskstation)
+		c.engine = usmEngine{}
+		c.engineStale = true
+	}
+}
+
+// restoreEngine sets the cached engine in the security parameters of the
+// next requests, with its time advanced since it was received (RFC 3414,
+// 2.2.1): they fall into its time window without a Report first, whatever
+// the time between the scrapes.
+func (c *Client) restoreEngine(snmp *gosnmp.GoSNMP) {
+	usm, ok := snmp.SecurityParameters.(*gosnmp.UsmSecurityParameters)
+	if !ok {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.engineStale {
+		usm.AuthoritativeEngineID = ""
+		c.engineStale = false
+		return
+	}
+	if c.engine.id == "" {
+		return
+	}
+	usm.AuthoritativeEngineID = c.engine.id
+	usm.AuthoritativeEngineBoots = c.engine.boots
+	usm.AuthoritativeEngineTime = c.engine.time + uint32(time.Since(c.engine.synced)/time.Second)
+}
@@ -0,0 +1,81 @@
+// Copyright (C) 2016 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syno
+
+import (
+	"context"
+
+	"github.com/prometheus/common/log"
+)
+
+// flight is a collection of the metrics of a plugin in progress. The
+// concurrent scrapes wait for it and share its result instead of walking
+// the same tables again.
+type flight struct {
+	done    chan struct{}
+	metrics interface{}
+	err     error
+
+	// callers is the number of scrapes waiting for the result, and cancel
+	// aborts the collection once they all gave up. Guarded by flightsMu.
+	callers int
+	cancel  context.CancelFunc
+}
+
+// collect fetches the metrics of the plugin, or waits for the result of the
+// collection already in progress for another scrape. The collection isn't
+// bound to the context of the scrape which started it: a scrape gives up
+// when its context is done, and the collection is aborted when no scrape
+// waits for it anymore.
+func (c *Client) collect(ctx context.Context, name string, plugin fetcher) (interface{}, error) {
+	c.flightsMu.Lock()
+	f, ok := c.flights[name]
+	if ok {
+		log.Debugf("[Client] Waiting for the collection of %s in progress", name)
+	} else {
+		// Keeps the values of the context, e.g. the prefetched ones
+		flightCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		f = &flight{done: make(chan struct{}), cancel: cancel}
+		c.flights[name] = f
+		go func() {
+			f.metrics, f.err = c.collectOnce(flightCtx, name, plugin)
+			cancel()
+			c.flightsMu.Lock()
+			if c.flights[name] == f {
+				delete(c.flights, name)
+			}
+			c.flightsMu.Unlock()
+			close(f.done)
+		}()
+	}
+	f.callers++
+	c.flightsMu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.metrics, f.err
+	case <-ctx.Done():
+		c.flightsMu.Lock()
+		f.callers--
+		if f.callers == 0 {
+			f.cancel()
+			if c.flights[name] == f {
+				delete(c.flights, name)
+			}
+		}
+		c.flightsMu.Unlock()
+		return nil, ctx.Err()
+	}
+}
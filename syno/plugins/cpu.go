@@ -15,40 +15,113 @@
 package plugins
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/prometheus/common/log"
 	"github.com/soniah/gosnmp"
 )
 
-type CPUPlugin struct{}
-
-func (p CPUPlugin) Fetch(snmp *gosnmp.GoSNMP) (map[string]float64, error) {
-	oids := []string{
-		".1.3.6.1.4.1.2021.11.50.0",
-		".1.3.6.1.4.1.2021.11.51.0",
-		".1.3.6.1.4.1.2021.11.52.0",
-		".1.3.6.1.4.1.2021.11.53.0",
-		".1.3.6.1.4.1.2021.11.54.0",
-		".1.3.6.1.4.1.2021.11.55.0",
-		".1.3.6.1.4.1.2021.11.56.0",
-		// ".1.3.6.1.4.1.9.2.1.58.0",
+var (
+	// systemStats from UCD-SNMP-MIB
+	cpuBase = ".1.3.6.1.4.1.2021.11"
+	cpuOIDs = map[string]string{
+		"user":      ".1.3.6.1.4.1.2021.11.50.0", // ssCpuRawUser
+		"nice":      ".1.3.6.1.4.1.2021.11.51.0", // ssCpuRawNice
+		"system":    ".1.3.6.1.4.1.2021.11.52.0", // ssCpuRawSystem
+		"idle":      ".1.3.6.1.4.1.2021.11.53.0", // ssCpuRawIdle
+		"wait":      ".1.3.6.1.4.1.2021.11.54.0", // ssCpuRawWait
+		"kernel":    ".1.3.6.1.4.1.2021.11.55.0", // ssCpuRawKernel
+		"interrupt": ".1.3.6.1.4.1.2021.11.56.0", // ssCpuRawInterrupt
 	}
-	log.Infof("[CPU Plugin] Get SNMP data")
-	result, err := snmp.Get(oids)
+
+	// hrProcessorLoad from HOST-RESOURCES-MIB: one entry per core
+	oidProcessorLoad = ".1.3.6.1.2.1.25.3.3.1.2"
+)
+
+// CPUMetrics are the CPU time counters, in ticks. The values are nil when
+// the Diskstation doesn't have them. System includes Kernel and Interrupt.
+type CPUMetrics struct {
+	User      *float64
+	Nice      *float64
+	System    *float64
+	Idle      *float64
+	Wait      *float64
+	Kernel    *float64
+	Interrupt *float64
+
+	// Cores is the load of each core, in percent, by index. It's only
+	// fetched with PerCore.
+	Cores map[int]float64
+}
+
+// CPUPlugin retrieves the CPU time counters of the Diskstation. With PerCore,
+// the load of each core is returned too. Base only moves the UCD-SNMP-MIB
+// counters.
+type CPUPlugin struct {
+	PerCore bool
+	Base    string
+}
+
+func (p CPUPlugin) Fetch(ctx context.Context, snmp SNMPGetter) (*CPUMetrics, error) {
+	log.Debugf("[CPU Plugin] Get SNMP data")
+	oids := rebaseAll(cpuOIDs, cpuBase, p.Base)
+	result, err := get(ctx, snmp, oidsOf(oids))
 	if err != nil {
 		return nil, fmt.Errorf("[CPU Plugin] SNMP Error: %v", err)
 	}
-	log.Debugf("SNMP System result: %s", result)
+	log.Debugf("SNMP System result: %v", result)
 	printSNMPResult(result)
-	return map[string]float64{
-		// "cpu-load": float64(result.Variables[0].Value.(uint)),
-		"cpu-0.cpu-user":      float64(gosnmp.ToBigInt(result.Variables[0].Value).Int64()),
-		"cpu-0.cpu-nice":      float64(gosnmp.ToBigInt(result.Variables[1].Value).Int64()),
-		"cpu-0.cpu-system":    float64(gosnmp.ToBigInt(result.Variables[2].Value).Int64()),
-		"cpu-0.cpu-idle":      float64(gosnmp.ToBigInt(result.Variables[3].Value).Int64()),
-		"cpu-0.cpu-wait":      float64(gosnmp.ToBigInt(result.Variables[4].Value).Int64()),
-		"cpu-0.cpu-kernel":    float64(gosnmp.ToBigInt(result.Variables[5].Value).Int64()),
-		"cpu-0.cpu-interrupt": float64(gosnmp.ToBigInt(result.Variables[6].Value).Int64()),
-	}, nil
+	metrics := cpuMetrics(result, oids)
+	if !p.PerCore {
+		return metrics, nil
+	}
+
+	cores, err := getCoresLoad(ctx, snmp)
+	if err != nil {
+		// Not fatal: the aggregated metrics are still available
+		log.Warnf("[CPU Plugin] Can't retrieve cores load: %v", err)
+		return metrics, nil
+	}
+	metrics.Cores = cores
+	return metrics, nil
+}
+
+func cpuMetrics(result *gosnmp.SnmpPacket, oids map[string]string) *CPUMetrics {
+	variables := variablesByOID(result)
+	return &CPUMetrics{
+		User:      numeric(variables[oids["user"]]),
+		Nice:      numeric(variables[oids["nice"]]),
+		System:    numeric(variables[oids["system"]]),
+		Idle:      numeric(variables[oids["idle"]]),
+		Wait:      numeric(variables[oids["wait"]]),
+		Kernel:    numeric(variables[oids["kernel"]]),
+		Interrupt: numeric(variables[oids["interrupt"]]),
+	}
+}
+
+func getCoresLoad(ctx context.Context, snmp SNMPGetter) (map[int]float64, error) {
+	log.Debugf("[CPU Plugin] Walk SNMP processors load")
+	variables, err := walkAll(ctx, snmp, oidProcessorLoad)
+	if err != nil {
+		return nil, fmt.Errorf("[CPU Plugin] SNMP Error: %v", err)
+	}
+	loads := map[int]float64{}
+	for i, variable := range variables {
+		if value, ok := numericValue(variable); ok {
+			loads[i] = value
+		}
+	}
+	return loads, nil
+}
+
+// DefaultBase implements Rebased
+func (p CPUPlugin) DefaultBase() string {
+	return cpuBase
+}
+
+// WithBase implements Rebased
+func (p CPUPlugin) WithBase(base string) Plugin {
+	p.Base = base
+	return p
 }
@@ -0,0 +1,80 @@
+// Copyright (C) 2016 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugins
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/common/log"
+)
+
+// CustomMetrics are the values of the custom OIDs, by metric name
+type CustomMetrics struct {
+	Values map[string][]CustomValue
+}
+
+// CustomValue is the value of a scalar OID, whose Index is empty, or of a
+// row of a table column.
+type CustomValue struct {
+	Index string
+	Value float64
+}
+
+// CustomPlugin retrieves the OIDs configured by the user, by metric name.
+// An OID may be a scalar or a table column, whose rows are keyed by their
+// index.
+type CustomPlugin struct {
+	OIDs map[string]string
+}
+
+// Scalar returns whether the OID of the metric is a scalar, i.e. an instance
+// ending with .0. The other OIDs are table columns.
+func (p CustomPlugin) Scalar(name string) bool {
+	return strings.HasSuffix(p.OIDs[name], ".0")
+}
+
+func (p CustomPlugin) Fetch(ctx context.Context, snmp SNMPGetter) (*CustomMetrics, error) {
+	metrics := &CustomMetrics{Values: map[string][]CustomValue{}}
+	for name, oid := range p.OIDs {
+		log.Debugf("[Custom Plugin] Walk SNMP %s: %s", name, oid)
+		variables, err := walkAll(ctx, snmp, oid)
+		if err != nil {
+			return nil, fmt.Errorf("[Custom Plugin] SNMP Error: %v", err)
+		}
+		for _, variable := range variables {
+			value, ok := numericValue(variable)
+			if !ok {
+				continue
+			}
+			index := strings.TrimPrefix(variable.Name, oid)
+			if index != "" && !strings.HasPrefix(index, ".") {
+				continue
+			}
+			// A scalar and table rows would be exported with different
+			// labels under the same name
+			if scalar := p.Scalar(name); scalar != (index == "") {
+				what := "table column"
+				if scalar {
+					what = "scalar"
+				}
+				return nil, fmt.Errorf("[Custom Plugin] Unexpected %s under the %s %s of %s", variable.Name, what, oid, name)
+			}
+			metrics.Values[name] = append(metrics.Values[name], CustomValue{Index: strings.TrimPrefix(index, "."), Value: value})
+		}
+	}
+	return metrics, nil
+}
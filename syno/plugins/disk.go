@@ -15,41 +15,167 @@
 package plugins
 
 import (
+	"context"
 	"fmt"
+	"regexp"
+	"strconv"
 
 	"github.com/prometheus/common/log"
 	"github.com/soniah/gosnmp"
 )
 
-type DiskPlugin struct{}
+var (
+	// diskTable from SYNOLOGY-DISK-MIB
+	diskBase           = ".1.3.6.1.4.1.6574.2"
+	oidDiskID          = ".1.3.6.1.4.1.6574.2.1.1.2" // diskID
+	oidDiskModel       = ".1.3.6.1.4.1.6574.2.1.1.3" // diskModel
+	oidDiskTemperature = ".1.3.6.1.4.1.6574.2.1.1.6" // diskTemperature
+	oidDiskBadSector   = ".1.3.6.1.4.1.6574.2.1.1.9" // diskBadSector, DSM 6.2 and later
+)
+
+// DiskMetrics are the disks of the Diskstation, by index
+type DiskMetrics struct {
+	Disks map[string]*Disk
+}
+
+// Disk holds the metrics of a disk. Info is nil when the Diskstation doesn't
+// list its model, and the values are nil when it doesn't have them.
+type Disk struct {
+	Info        *DiskInfo
+	Temperature *float64
+	BadSectors  *float64
+}
 
-func (p DiskPlugin) Fetch(snmp *gosnmp.GoSNMP) (map[string]float64, error) {
-	metrics := map[string]float64{}
-	temperatures, err := getTemperatures(snmp)
+// DiskInfo describes a disk
+type DiskInfo struct {
+	// ID locates the disk, e.g. "Disk 1"
+	ID    string
+	Model string
+	// Enclosure is "main" for the disks of the Diskstation, or the name
+	// of their expansion unit
+	Enclosure string
+}
+
+type DiskPlugin struct {
+	Base string
+}
+
+func (p DiskPlugin) Fetch(ctx context.Context, snmp SNMPGetter) (*DiskMetrics, error) {
+	metrics := &DiskMetrics{Disks: map[string]*Disk{}}
+	disk := func(index string) *Disk {
+		if metrics.Disks[index] == nil {
+			metrics.Disks[index] = &Disk{}
+		}
+		return metrics.Disks[index]
+	}
+	temperatures, err := p.getTemperatures(ctx, snmp)
 	if err != nil {
 		return nil, fmt.Errorf("[Disk Plugin] SNMP Temperature error: %v", err)
 	}
-	for key, value := range temperatures {
-		metrics[fmt.Sprintf("disk.disk-%v.temperature", key)] = value
+	for index, value := range temperatures {
+		value := value
+		disk(index).Temperature = &value
+	}
+	log.Debugf("[Disk Plugin] Walk SNMP disk bad sectors")
+	badSectors, err := walkTable(ctx, snmp, p.oid(oidDiskBadSector))
+	if err != nil {
+		return nil, fmt.Errorf("[Disk Plugin] SNMP Bad sectors error: %v", err)
+	}
+	for index, variable := range badSectors {
+		if value := numeric(variable); value != nil {
+			disk(index).BadSectors = value
+		}
+	}
+	infos, err := p.getInfos(ctx, snmp)
+	if err != nil {
+		return nil, fmt.Errorf("[Disk Plugin] SNMP Info error: %v", err)
+	}
+	for index, info := range infos {
+		disk(index).Info = info
 	}
 	return metrics, nil
 }
 
-func getTemperatures(snmp *gosnmp.GoSNMP) (map[int]float64, error) {
-	log.Infof("[Disk Plugin] Get SNMP disk temperatures")
-	result, err := snmp.Get([]string{
-		".1.3.6.1.4.1.6574.2.1.1.6.0",
-		// ".1.3.6.1.4.1.6574.2.1.1.6.1",
-	})
+// getTemperatures walks the disk temperatures, keyed by the disk index. Some
+// DSM versions return them as strings (e.g. "42") instead of integers.
+func (p DiskPlugin) getTemperatures(ctx context.Context, snmp SNMPGetter) (map[string]float64, error) {
+	log.Debugf("[Disk Plugin] Walk SNMP disk temperatures")
+	rows, err := walkTable(ctx, snmp, p.oid(oidDiskTemperature))
 	if err != nil {
 		return nil, fmt.Errorf("[Disk Plugin] SNMP Error: %v", err)
 	}
-	log.Debugf("SNMP System result: %s", result)
-	printSNMPResult(result)
-
-	temps := map[int]float64{}
-	for i, variable := range result.Variables {
-		temps[i] = float64(gosnmp.ToBigInt(variable.Value).Int64())
+	temps := map[string]float64{}
+	for index, variable := range rows {
+		if variable.Type == gosnmp.OctetString {
+			value, err := strconv.Atoi(stringValue(variable))
+			if err != nil {
+				log.Warnf("[Disk Plugin] Invalid temperature for disk %s: %q", index, variable.Value)
+				continue
+			}
+			temps[index] = float64(value)
+			continue
+		}
+		if value, ok := numericValue(variable); ok {
+			temps[index] = value
+		}
 	}
 	return temps, nil
 }
+
+// getInfos walks the disk IDs and models, keyed by the disk index. The
+// Synology MIB has no serial number column, so the ID (e.g. "Disk 1") is what
+// locates the physical drive.
+func (p DiskPlugin) getInfos(ctx context.Context, snmp SNMPGetter) (map[string]*DiskInfo, error) {
+	log.Debugf("[Disk Plugin] Walk SNMP disk models")
+	ids, err := walkTable(ctx, snmp, p.oid(oidDiskID))
+	if err != nil {
+		return nil, fmt.Errorf("[Disk Plugin] SNMP Error: %v", err)
+	}
+	models, err := walkTable(ctx, snmp, p.oid(oidDiskModel))
+	if err != nil {
+		return nil, fmt.Errorf("[Disk Plugin] SNMP Error: %v", err)
+	}
+	return parseDiskInfos(ids, models), nil
+}
+
+// parseDiskInfos returns the ID, model and enclosure of the disks, keyed by
+// their index.
+func parseDiskInfos(ids map[string]gosnmp.SnmpPDU, models map[string]gosnmp.SnmpPDU) map[string]*DiskInfo {
+	infos := map[string]*DiskInfo{}
+	for index, variable := range models {
+		id := stringValue(ids[index])
+		infos[index] = &DiskInfo{ID: id, Model: stringValue(variable), Enclosure: diskEnclosure(id)}
+	}
+	return infos
+}
+
+// diskIDRE matches the disk IDs: "Disk 1" for the disks of the Diskstation,
+// and e.g. "DX517-1 Disk 1" for the ones of its expansion units, whose indices
+// follow the ones of the Diskstation disks.
+var diskIDRE = regexp.MustCompile(`^(?:(.+) )?Disk \d+$`)
+
+// diskEnclosure returns the unit of the disk from its ID: "main" for the
+// Diskstation, or the name of the expansion unit (e.g. "DX517-1").
+func diskEnclosure(id string) string {
+	match := diskIDRE.FindStringSubmatch(id)
+	if match == nil || match[1] == "" {
+		return "main"
+	}
+	return match[1]
+}
+
+// oid returns the OID of the column under Base
+func (p DiskPlugin) oid(column string) string {
+	return rebase(column, diskBase, p.Base)
+}
+
+// DefaultBase implements Rebased
+func (p DiskPlugin) DefaultBase() string {
+	return diskBase
+}
+
+// WithBase implements Rebased
+func (p DiskPlugin) WithBase(base string) Plugin {
+	p.Base = base
+	return p
+}
@@ -0,0 +1,139 @@
+// Copyright (C) 2016 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugins
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/prometheus/common/log"
+	"github.com/soniah/gosnmp"
+)
+
+var (
+	// storageIOTable from SYNOLOGY-STORAGEIO-MIB
+	diskIOBase         = ".1.3.6.1.4.1.6574.101"
+	oidStorageIODevice = ".1.3.6.1.4.1.6574.101.1.1.2"
+	diskIOOIDs         = map[string]string{
+		"reads":  ".1.3.6.1.4.1.6574.101.1.1.5", // storageIOReads
+		"writes": ".1.3.6.1.4.1.6574.101.1.1.6", // storageIOWrites
+		"load":   ".1.3.6.1.4.1.6574.101.1.1.8", // storageIOLA
+	}
+
+	// storageIONRead and storageIONWritten wrap at 4 GiB: the 64 bits
+	// storageIONReadX and storageIONWrittenX aren't available with SNMPv1
+	diskIOBytesOIDs = map[string]string{
+		"read-bytes":    ".1.3.6.1.4.1.6574.101.1.1.3", // storageIONRead
+		"written-bytes": ".1.3.6.1.4.1.6574.101.1.1.4", // storageIONWritten
+	}
+	diskIOBytesHCOIDs = map[string]string{
+		"read-bytes":    ".1.3.6.1.4.1.6574.101.1.1.12", // storageIONReadX
+		"written-bytes": ".1.3.6.1.4.1.6574.101.1.1.13", // storageIONWrittenX
+	}
+)
+
+// DiskIOMetrics are the IO counters of the disks, by device name
+type DiskIOMetrics struct {
+	Devices map[string]*DiskIO
+}
+
+// DiskIO holds the IO counters of a disk. They are nil when the Diskstation
+// doesn't have them.
+type DiskIO struct {
+	Reads        *float64
+	Writes       *float64
+	ReadBytes    *float64
+	WrittenBytes *float64
+	// Load is the load of the disk, in percent
+	Load *float64
+}
+
+type DiskIOPlugin struct {
+	Base string
+}
+
+func (p DiskIOPlugin) Fetch(ctx context.Context, snmp SNMPGetter) (*DiskIOMetrics, error) {
+	log.Debugf("[DiskIO Plugin] Walk SNMP storage IO")
+	devices, err := walkTable(ctx, snmp, p.oid(oidStorageIODevice))
+	if err != nil {
+		return nil, fmt.Errorf("[DiskIO Plugin] SNMP Error: %v", err)
+	}
+	columns := map[string]string{}
+	for name, oid := range diskIOOIDs {
+		columns[name] = oid
+	}
+	bytesOIDs := diskIOBytesHCOIDs
+	if snmp.SNMPVersion() == gosnmp.Version1 {
+		bytesOIDs = diskIOBytesOIDs
+	}
+	for name, oid := range bytesOIDs {
+		columns[name] = oid
+	}
+
+	metrics := &DiskIOMetrics{Devices: map[string]*DiskIO{}}
+	for name, oid := range columns {
+		rows, err := walkTable(ctx, snmp, p.oid(oid))
+		if err != nil {
+			return nil, fmt.Errorf("[DiskIO Plugin] SNMP Error: %v", err)
+		}
+		for index, variable := range rows {
+			value := numeric(variable)
+			if value == nil {
+				continue
+			}
+			device := index
+			if descr, ok := devices[index].Value.([]byte); ok {
+				device = string(descr)
+			}
+			if metrics.Devices[device] == nil {
+				metrics.Devices[device] = &DiskIO{}
+			}
+			metrics.Devices[device].set(name, value)
+		}
+	}
+	return metrics, nil
+}
+
+// set sets the value of the column, e.g. reads
+func (d *DiskIO) set(column string, value *float64) {
+	switch column {
+	case "reads":
+		d.Reads = value
+	case "writes":
+		d.Writes = value
+	case "read-bytes":
+		d.ReadBytes = value
+	case "written-bytes":
+		d.WrittenBytes = value
+	case "load":
+		d.Load = value
+	}
+}
+
+// oid returns the OID of the column under Base
+func (p DiskIOPlugin) oid(column string) string {
+	return rebase(column, diskIOBase, p.Base)
+}
+
+// DefaultBase implements Rebased
+func (p DiskIOPlugin) DefaultBase() string {
+	return diskIOBase
+}
+
+// WithBase implements Rebased
+func (p DiskIOPlugin) WithBase(base string) Plugin {
+	p.Base = base
+	return p
+}
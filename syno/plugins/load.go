@@ -15,30 +15,94 @@
 package plugins
 
 import (
+	"context"
 	"fmt"
+	"strconv"
 
 	"github.com/prometheus/common/log"
 	"github.com/soniah/gosnmp"
 )
 
-type LoadPlugin struct{}
+var (
+	// laLoadFloat from UCD-SNMP-MIB: the load average, as an Opaque float
+	// or, on some agents, a string such as "0.73"
+	loadBase = ".1.3.6.1.4.1.2021.10"
+	loadOIDs = map[string]string{
+		"short": ".1.3.6.1.4.1.2021.10.1.6.1",
+		"mid":   ".1.3.6.1.4.1.2021.10.1.6.2",
+		"long":  ".1.3.6.1.4.1.2021.10.1.6.3",
+	}
+)
+
+// LoadMetrics are the 1, 5 and 15 minutes load averages. The values are nil
+// when the Diskstation doesn't have them.
+type LoadMetrics struct {
+	Short *float64
+	Mid   *float64
+	Long  *float64
+}
+
+type LoadPlugin struct {
+	Base string
+}
 
-func (p LoadPlugin) Fetch(snmp *gosnmp.GoSNMP) (map[string]float64, error) {
-	log.Infof("[Load Plugin] Retrieve metrics")
-	result, err := snmp.Get([]string{
-		".1.3.6.1.4.1.2021.10.1.5.1",
-		".1.3.6.1.4.1.2021.10.1.5.2",
-		".1.3.6.1.4.1.2021.10.1.5.3",
-	})
+func (p LoadPlugin) Fetch(ctx context.Context, snmp SNMPGetter) (*LoadMetrics, error) {
+	log.Debugf("[Load Plugin] Retrieve metrics")
+	result, err := get(ctx, snmp, p.OIDs())
 	if err != nil {
 		return nil, fmt.Errorf("[Load Plugin] SNMP Error: %v", err)
 	}
-	log.Debugf("SNMP System result: %s", result)
+	log.Debugf("SNMP System result: %v", result)
 	printSNMPResult(result)
+	return p.Parse(variablesByOID(result)), nil
+}
+
+// OIDs returns the OIDs of the load metrics
+func (p LoadPlugin) OIDs() []string {
+	return oidsOf(p.oids())
+}
+
+// Parse returns the load metrics from the values of their OIDs
+func (p LoadPlugin) Parse(variables map[string]gosnmp.SnmpPDU) *LoadMetrics {
+	oids := p.oids()
+	load := func(key string) *float64 {
+		if value, ok := loadValue(variables[oids[key]]); ok {
+			return &value
+		}
+		return nil
+	}
+	return &LoadMetrics{
+		Short: load("short"),
+		Mid:   load("mid"),
+		Long:  load("long"),
+	}
+}
+
+func (p LoadPlugin) oids() map[string]string {
+	return rebaseAll(loadOIDs, loadBase, p.Base)
+}
+
+// DefaultBase implements Rebased
+func (p LoadPlugin) DefaultBase() string {
+	return loadBase
+}
 
-	return map[string]float64{
-		"load.shortterm": float64(gosnmp.ToBigInt(result.Variables[0].Value).Int64()) / 100,
-		"load.midterm":   float64(gosnmp.ToBigInt(result.Variables[1].Value).Int64()) / 100,
-		"load.longterm":  float64(gosnmp.ToBigInt(result.Variables[2].Value).Int64()) / 100,
-	}, nil
+// WithBase implements Rebased
+func (p LoadPlugin) WithBase(base string) Plugin {
+	p.Base = base
+	return p
+}
+
+// loadValue returns the load average of a laLoadFloat variable, or false if
+// the agent doesn't have it or it's not a number.
+func loadValue(variable gosnmp.SnmpPDU) (float64, bool) {
+	if variable.Type != gosnmp.OctetString {
+		return numericValue(variable)
+	}
+	value, err := strconv.ParseFloat(stringValue(variable), 64)
+	if err != nil {
+		log.Warnf("[Load Plugin] Invalid load average %s: %q", variable.Name, variable.Value)
+		return 0, false
+	}
+	return value, true
 }
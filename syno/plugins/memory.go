@@ -15,41 +15,94 @@
 package plugins
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/prometheus/common/log"
 	"github.com/soniah/gosnmp"
 )
 
-type MemoryPlugin struct{}
-
-func (p MemoryPlugin) Fetch(snmp *gosnmp.GoSNMP) (map[string]float64, error) {
-	oids := []string{
-		".1.3.6.1.4.1.2021.4.3.0",  // memTotalSwap
-		".1.3.6.1.4.1.2021.4.4.0",  // memAvailSwap
-		".1.3.6.1.4.1.2021.4.5.0",  // memTotalReal
-		".1.3.6.1.4.1.2021.4.6.0",  // memAvailReal
-		".1.3.6.1.4.1.2021.4.11.0", // memTotalFree
-		".1.3.6.1.4.1.2021.4.13.0", // memShared
-		".1.3.6.1.4.1.2021.4.14.0", // memBuffer
-		".1.3.6.1.4.1.2021.4.15.0", // memCached
+var (
+	// memory from UCD-SNMP-MIB, in kB
+	memoryBase = ".1.3.6.1.4.1.2021.4"
+	memoryOIDs = map[string]string{
+		"totalSwap": ".1.3.6.1.4.1.2021.4.3.0",  // memTotalSwap
+		"availSwap": ".1.3.6.1.4.1.2021.4.4.0",  // memAvailSwap
+		"totalReal": ".1.3.6.1.4.1.2021.4.5.0",  // memTotalReal
+		"availReal": ".1.3.6.1.4.1.2021.4.6.0",  // memAvailReal
+		"totalFree": ".1.3.6.1.4.1.2021.4.11.0", // memTotalFree
+		"shared":    ".1.3.6.1.4.1.2021.4.13.0", // memShared
+		"buffer":    ".1.3.6.1.4.1.2021.4.14.0", // memBuffer
+		"cached":    ".1.3.6.1.4.1.2021.4.15.0", // memCached
 	}
-	log.Infof("[Memory Plugin] Get SNMP data")
-	result, err := snmp.Get(oids)
+)
+
+// MemoryMetrics are the memory sizes of the Diskstation, in bytes. The
+// values are nil when the Diskstation doesn't have them.
+type MemoryMetrics struct {
+	TotalSwap *float64
+	AvailSwap *float64
+	TotalReal *float64
+	AvailReal *float64
+	TotalFree *float64
+	Shared    *float64
+	Buffer    *float64
+	Cached    *float64
+}
+
+type MemoryPlugin struct {
+	Base string
+}
+
+func (p MemoryPlugin) Fetch(ctx context.Context, snmp SNMPGetter) (*MemoryMetrics, error) {
+	log.Debugf("[Memory Plugin] Get SNMP data")
+	result, err := get(ctx, snmp, p.OIDs())
 	if err != nil {
 		return nil, fmt.Errorf("[Memory Plugin] SNMP Error: %v", err)
 	}
-	log.Debugf("SNMP System result: %s", result)
+	log.Debugf("SNMP System result: %v", result)
 	printSNMPResult(result)
+	return p.Parse(variablesByOID(result)), nil
+}
+
+// OIDs returns the OIDs of the memory metrics
+func (p MemoryPlugin) OIDs() []string {
+	return oidsOf(p.oids())
+}
+
+// Parse returns the memory metrics in bytes
+func (p MemoryPlugin) Parse(variables map[string]gosnmp.SnmpPDU) *MemoryMetrics {
+	oids := p.oids()
+	bytes := func(key string) *float64 {
+		value := numeric(variables[oids[key]])
+		if value != nil {
+			*value *= 1024
+		}
+		return value
+	}
+	return &MemoryMetrics{
+		TotalSwap: bytes("totalSwap"),
+		AvailSwap: bytes("availSwap"),
+		TotalReal: bytes("totalReal"),
+		AvailReal: bytes("availReal"),
+		TotalFree: bytes("totalFree"),
+		Shared:    bytes("shared"),
+		Buffer:    bytes("buffer"),
+		Cached:    bytes("cached"),
+	}
+}
+
+func (p MemoryPlugin) oids() map[string]string {
+	return rebaseAll(memoryOIDs, memoryBase, p.Base)
+}
+
+// DefaultBase implements Rebased
+func (p MemoryPlugin) DefaultBase() string {
+	return memoryBase
+}
 
-	return map[string]float64{
-		"mem-total-swap": float64(gosnmp.ToBigInt(result.Variables[0].Value).Int64()),
-		"mem-avail-swap": float64(gosnmp.ToBigInt(result.Variables[1].Value).Int64()),
-		"mem-total-real": float64(gosnmp.ToBigInt(result.Variables[2].Value).Int64()),
-		"mem-avail-real": float64(gosnmp.ToBigInt(result.Variables[3].Value).Int64()),
-		"mem-total-free": float64(gosnmp.ToBigInt(result.Variables[4].Value).Int64()),
-		"mem-shared":     float64(gosnmp.ToBigInt(result.Variables[5].Value).Int64()),
-		"mem-buffer":     float64(gosnmp.ToBigInt(result.Variables[6].Value).Int64()),
-		"mem-cached":     float64(gosnmp.ToBigInt(result.Variables[7].Value).Int64()),
-	}, nil
+// WithBase implements Rebased
+func (p MemoryPlugin) WithBase(base string) Plugin {
+	p.Base = base
+	return p
 }
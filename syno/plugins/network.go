@@ -15,30 +15,175 @@
 package plugins
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/prometheus/common/log"
 	"github.com/soniah/gosnmp"
 )
 
-type NetworkPlugin struct{}
+var (
+	// ifTable from IF-MIB
+	oidIfDescr       = ".1.3.6.1.2.1.2.2.1.2"
+	oidIfType        = ".1.3.6.1.2.1.2.2.1.3"
+	oidIfInOctets    = ".1.3.6.1.2.1.2.2.1.10"
+	oidIfOutOctets   = ".1.3.6.1.2.1.2.2.1.16"
+	oidIfInDiscards  = ".1.3.6.1.2.1.2.2.1.13"
+	oidIfInErrors    = ".1.3.6.1.2.1.2.2.1.14"
+	oidIfOutDiscards = ".1.3.6.1.2.1.2.2.1.19"
+	oidIfOutErrors   = ".1.3.6.1.2.1.2.2.1.20"
 
-func (p NetworkPlugin) Fetch(snmp *gosnmp.GoSNMP) (map[string]float64, error) {
-	oids := []string{
-		// ".1.3.6.1.2.1.31.1.1.1.1", // ifName
-		".1.3.6.1.2.1.31.1.1.1.6",  // ifHCInOctets
-		".1.3.6.1.2.1.31.1.1.1.10", // ifHCOutOctets
+	// softwareLoopback from IANAifType-MIB
+	ifTypeSoftwareLoopback = int64(24)
+
+	// ifXTable from IF-MIB: 64 bits counters, not available with SNMPv1
+	oidIfHCInOctets  = ".1.3.6.1.2.1.31.1.1.1.6"
+	oidIfHCOutOctets = ".1.3.6.1.2.1.31.1.1.1.10"
+)
+
+// NetworkMetrics are the traffic of the network interfaces, in bytes
+type NetworkMetrics struct {
+	// In and Out are the total traffic of the interfaces but the loopback
+	In  float64
+	Out float64
+
+	// Interfaces are the counters of each interface, by name. They're only
+	// fetched with PerInterface.
+	Interfaces map[string]*InterfaceMetrics
+}
+
+// InterfaceMetrics are the counters of a network interface. They are nil
+// when the Diskstation doesn't have them.
+type InterfaceMetrics struct {
+	InOctets    *float64
+	OutOctets   *float64
+	InErrors    *float64
+	OutErrors   *float64
+	InDiscards  *float64
+	OutDiscards *float64
+}
+
+// NetworkPlugin retrieves the traffic of the network interfaces. With
+// PerInterface, the traffic, errors and discards of each interface are
+// returned too, besides the totals.
+type NetworkPlugin struct {
+	PerInterface bool
+}
+
+func (p NetworkPlugin) Fetch(ctx context.Context, snmp SNMPGetter) (*NetworkMetrics, error) {
+	// 32 bits counters wrap quickly on gigabit interfaces, so prefer the
+	// high capacity ones when the SNMP version supports Counter64.
+	inOctets, outOctets := oidIfHCInOctets, oidIfHCOutOctets
+	if snmp.SNMPVersion() == gosnmp.Version1 {
+		inOctets, outOctets = oidIfInOctets, oidIfOutOctets
 	}
-	log.Infof("[Net Plugin] Get SNMP data")
-	result, err := snmp.Get(oids)
+	log.Debugf("[Net Plugin] Walk SNMP interfaces traffic")
+	types, err := walkTable(ctx, snmp, oidIfType)
 	if err != nil {
 		return nil, fmt.Errorf("[Net Plugin] SNMP Error: %v", err)
 	}
-	log.Debugf("SNMP System result: %s", result)
-	printSNMPResult(result)
+	in, err := walkInterfaces(ctx, snmp, inOctets, types)
+	if err != nil {
+		return nil, fmt.Errorf("[Net Plugin] SNMP Error: %v", err)
+	}
+	out, err := walkInterfaces(ctx, snmp, outOctets, types)
+	if err != nil {
+		return nil, fmt.Errorf("[Net Plugin] SNMP Error: %v", err)
+	}
+
+	metrics := &NetworkMetrics{In: sum(in), Out: sum(out)}
+	if !p.PerInterface {
+		return metrics, nil
+	}
+
+	descrs, err := walkTable(ctx, snmp, oidIfDescr)
+	if err != nil {
+		// Not fatal: the total traffic is still available
+		log.Warnf("[Net Plugin] Can't retrieve interfaces names: %v", err)
+		return metrics, nil
+	}
+	metrics.Interfaces = map[string]*InterfaceMetrics{}
+	addInterfaces(metrics, "in-octets", in, descrs)
+	addInterfaces(metrics, "out-octets", out, descrs)
+
+	for counter, oid := range map[string]string{
+		"in-errors":    oidIfInErrors,
+		"out-errors":   oidIfOutErrors,
+		"in-discards":  oidIfInDiscards,
+		"out-discards": oidIfOutDiscards,
+	} {
+		log.Debugf("[Net Plugin] Walk SNMP interfaces %s", counter)
+		rows, err := walkInterfaces(ctx, snmp, oid, types)
+		if err != nil {
+			// Not fatal: the traffic metrics are still available
+			log.Warnf("[Net Plugin] Can't retrieve interfaces %s: %v", counter, err)
+			continue
+		}
+		addInterfaces(metrics, counter, rows, descrs)
+	}
+	return metrics, nil
+}
+
+// walkInterfaces walks a counter column of the interfaces tables, skipping
+// the loopback. Values are by interface index.
+func walkInterfaces(ctx context.Context, snmp SNMPGetter, column string, types map[string]gosnmp.SnmpPDU) (map[string]float64, error) {
+	rows, err := walkTable(ctx, snmp, column)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]float64{}
+	for index, variable := range rows {
+		if isLoopback(types, index) {
+			continue
+		}
+		values[index] = toFloat64(variable.Value)
+		if variable.Type == gosnmp.Counter32 {
+			recordCounter(ctx, variable.Name, values[index])
+		}
+	}
+	return values, nil
+}
+
+// addInterfaces sets the values of a counter of the interfaces, by index
+func addInterfaces(metrics *NetworkMetrics, counter string, values map[string]float64, descrs map[string]gosnmp.SnmpPDU) {
+	for index, value := range values {
+		name := index
+		if descr, ok := descrs[index].Value.([]byte); ok {
+			name = string(descr)
+		}
+		if metrics.Interfaces[name] == nil {
+			metrics.Interfaces[name] = &InterfaceMetrics{}
+		}
+		metrics.Interfaces[name].set(counter, value)
+	}
+}
+
+// set sets the value of the counter, e.g. in-octets
+func (i *InterfaceMetrics) set(counter string, value float64) {
+	switch counter {
+	case "in-octets":
+		i.InOctets = &value
+	case "out-octets":
+		i.OutOctets = &value
+	case "in-errors":
+		i.InErrors = &value
+	case "out-errors":
+		i.OutErrors = &value
+	case "in-discards":
+		i.InDiscards = &value
+	case "out-discards":
+		i.OutDiscards = &value
+	}
+}
+
+func sum(values map[string]float64) float64 {
+	var total float64
+	for _, value := range values {
+		total += value
+	}
+	return total
+}
 
-	return map[string]float64{
-		"net-in":  float64(gosnmp.ToBigInt(result.Variables[0].Value).Int64()),
-		"net-out": float64(gosnmp.ToBigInt(result.Variables[1].Value).Int64()),
-	}, nil
+func isLoopback(types map[string]gosnmp.SnmpPDU, index string) bool {
+	return gosnmp.ToBigInt(types[index].Value).Int64() == ifTypeSoftwareLoopback
 }
@@ -15,13 +15,45 @@
 package plugins
 
 import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+
 	"github.com/prometheus/common/log"
 	"github.com/soniah/gosnmp"
 )
 
-// Plugin defines a SNMP receiver
-type Plugin interface {
-	Fetch(snmp *gosnmp.GoSNMP) (map[string]float64, error)
+// Plugin defines a SNMP receiver: a Fetcher of its own metrics type, e.g.
+// the SystemPlugin is a Fetcher[*SystemMetrics].
+type Plugin interface{}
+
+// Fetcher retrieves the metrics of a plugin. Fetch gives up as soon as the
+// context is done.
+type Fetcher[M any] interface {
+	Fetch(ctx context.Context, snmp SNMPGetter) (M, error)
+}
+
+// ScalarPlugin is a Plugin which only gets scalar values, the ones of OIDs.
+// The client may retrieve them in bulk with the ones of the other plugins,
+// and give them to its Parser instead of calling Fetch.
+type ScalarPlugin interface {
+	OIDs() []string
+}
+
+// Parser returns the metrics of a ScalarPlugin from the values of its OIDs,
+// or nil when they aren't enough, so that Fetch is called.
+type Parser[M any] interface {
+	Parse(variables map[string]gosnmp.SnmpPDU) M
+}
+
+// Rebased is a Plugin whose OIDs are under the base OID of a Synology or UCD
+// MIB. As DSM versions may move them, the base can be overridden.
+type Rebased interface {
+	// DefaultBase returns the base OID used when it isn't overridden
+	DefaultBase() string
+	// WithBase returns the plugin getting its OIDs under base
+	WithBase(base string) Plugin
 }
 
 func printSNMPResult(result *gosnmp.SnmpPacket) {
@@ -35,3 +67,233 @@ func printSNMPResult(result *gosnmp.SnmpPacket) {
 		}
 	}
 }
+
+// stringValue returns the value of an OctetString variable, without the
+// padding spaces, or "" if it's not a string.
+func stringValue(variable gosnmp.SnmpPDU) string {
+	if value, ok := variable.Value.([]byte); ok {
+		return strings.TrimSpace(string(value))
+	}
+	return ""
+}
+
+// timeTicksToSeconds converts a TimeTicks value, in hundredths of a second,
+// to seconds. gosnmp decodes TimeTicks as a signed int whereas it's an
+// unsigned 32 bits integer, so values above 2^31 (~248 days) are wrapped back.
+func timeTicksToSeconds(value interface{}) float64 {
+	switch ticks := value.(type) {
+	case int:
+		return float64(uint32(ticks)) / 100
+	default:
+		return float64(gosnmp.ToBigInt(value).Int64()) / 100
+	}
+}
+
+// RequestRecorder is called for each SNMP request sent by the plugins, with
+// the request type (get or walk) and its error if it failed.
+type RequestRecorder func(request string, err error)
+
+type recorderKey struct{}
+
+// WithRequestRecorder returns a context recording the SNMP requests sent by
+// the plugins fetching with it.
+func WithRequestRecorder(ctx context.Context, recorder RequestRecorder) context.Context {
+	return context.WithValue(ctx, recorderKey{}, recorder)
+}
+
+func recordRequest(ctx context.Context, request string, err error) {
+	if recorder, ok := ctx.Value(recorderKey{}).(RequestRecorder); ok {
+		recorder(request, err)
+	}
+}
+
+// CounterRecorder is called with the values of the 32 bits counters walked by
+// the plugins, by OID, to detect when they wrap.
+type CounterRecorder func(oid string, value float64)
+
+type counterRecorderKey struct{}
+
+// WithCounterRecorder returns a context recording the 32 bits counters
+// walked by the plugins fetching with it.
+func WithCounterRecorder(ctx context.Context, recorder CounterRecorder) context.Context {
+	return context.WithValue(ctx, counterRecorderKey{}, recorder)
+}
+
+func recordCounter(ctx context.Context, oid string, value float64) {
+	if recorder, ok := ctx.Value(counterRecorderKey{}).(CounterRecorder); ok {
+		recorder(oid, value)
+	}
+}
+
+// StatusError is returned when the agent answered a Get request with an error
+// status. Index is the position, from 1, of the OID which caused it, or 0.
+type StatusError struct {
+	Status gosnmp.SNMPError
+	Index  int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("SNMP error status %d at index %d", e.Status, e.Index)
+}
+
+// get retrieves the values of the OIDs, unless the context is done.
+func get(ctx context.Context, snmp SNMPGetter, oids []string) (*gosnmp.SnmpPacket, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	result, err := snmp.Get(oids)
+	if err == nil && result.Error != gosnmp.NoError {
+		err = &StatusError{Status: result.Error, Index: int(result.ErrorIndex)}
+	}
+	recordRequest(ctx, "get", err)
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckResponse(oids, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// getEach retrieves the values of the OIDs with a Get request each, for the
+// agents failing the whole request when one of them is missing (noSuchName
+// of SNMPv1). The OIDs answered with an error are skipped.
+func getEach(ctx context.Context, snmp SNMPGetter, oids []string) (*gosnmp.SnmpPacket, error) {
+	result := &gosnmp.SnmpPacket{}
+	for _, oid := range oids {
+		packet, err := get(ctx, snmp, []string{oid})
+		if status, ok := err.(*StatusError); ok {
+			log.Debugf("[Plugin] Skip %s: SNMP error %d", oid, status.Status)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		result.Variables = append(result.Variables, packet.Variables...)
+	}
+	return result, nil
+}
+
+// CheckResponse returns an error naming the missing OIDs if the response to
+// a Get request has fewer variables than the requested OIDs, e.g. when the
+// agent truncated it.
+func CheckResponse(oids []string, result *gosnmp.SnmpPacket) error {
+	if len(result.Variables) >= len(oids) {
+		return nil
+	}
+	variables := variablesByOID(result)
+	var missing []string
+	for _, oid := range oids {
+		if _, ok := variables[oid]; !ok {
+			missing = append(missing, oid)
+		}
+	}
+	return fmt.Errorf("Short SNMP response: %d variables for %d OIDs, missing %s",
+		len(result.Variables), len(oids), strings.Join(missing, ","))
+}
+
+// walkAll retrieves the subtree of the OID, unless the context is done.
+func walkAll(ctx context.Context, snmp SNMPGetter, oid string) ([]gosnmp.SnmpPDU, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	variables, err := snmp.Walk(oid)
+	recordRequest(ctx, "walk", err)
+	return variables, err
+}
+
+// walkTable retrieves a column of a SNMP table, keyed by the row index (the
+// OID suffix after the column OID).
+func walkTable(ctx context.Context, snmp SNMPGetter, column string) (map[string]gosnmp.SnmpPDU, error) {
+	variables, err := walkAll(ctx, snmp, column)
+	if err != nil {
+		return nil, err
+	}
+	rows := map[string]gosnmp.SnmpPDU{}
+	for _, variable := range variables {
+		if !exists(variable) {
+			continue
+		}
+		rows[strings.TrimPrefix(variable.Name, column+".")] = variable
+	}
+	return rows, nil
+}
+
+// rebase returns the oid under base instead of defaultBase. The OIDs which
+// aren't under defaultBase, and all of them when base is empty, are kept.
+func rebase(oid string, defaultBase string, base string) string {
+	if base == "" || !strings.HasPrefix(oid+".", defaultBase+".") {
+		return oid
+	}
+	return base + strings.TrimPrefix(oid, defaultBase)
+}
+
+// rebaseAll returns the metric key to OID mapping with the OIDs rebased
+func rebaseAll(oids map[string]string, defaultBase string, base string) map[string]string {
+	rebased := make(map[string]string, len(oids))
+	for key, oid := range oids {
+		rebased[key] = rebase(oid, defaultBase, base)
+	}
+	return rebased
+}
+
+// oidsOf returns the OIDs of a metric key to OID mapping
+func oidsOf(oids map[string]string) []string {
+	values := make([]string, 0, len(oids))
+	for _, oid := range oids {
+		values = append(values, oid)
+	}
+	return values
+}
+
+// variablesByOID indexes the variables of a SNMP response by their OID, so
+// the values don't depend on the order of the response.
+func variablesByOID(result *gosnmp.SnmpPacket) map[string]gosnmp.SnmpPDU {
+	variables := make(map[string]gosnmp.SnmpPDU, len(result.Variables))
+	for _, variable := range result.Variables {
+		variables["."+strings.TrimPrefix(variable.Name, ".")] = variable
+	}
+	return variables
+}
+
+// exists returns false if the agent doesn't have the variable: the OID isn't
+// supported, the instance doesn't exist or it's after the end of the MIB.
+func exists(variable gosnmp.SnmpPDU) bool {
+	switch variable.Type {
+	case gosnmp.NoSuchObject, gosnmp.NoSuchInstance, gosnmp.EndOfMibView, gosnmp.Null:
+		return false
+	}
+	return variable.Value != nil
+}
+
+// numeric returns the value of the variable, or nil if the agent doesn't
+// have it.
+func numeric(variable gosnmp.SnmpPDU) *float64 {
+	if value, ok := numericValue(variable); ok {
+		return &value
+	}
+	return nil
+}
+
+// numericValue returns the value of the variable, or false if the agent
+// doesn't have it.
+func numericValue(variable gosnmp.SnmpPDU) (float64, bool) {
+	if !exists(variable) {
+		return 0, false
+	}
+	return toFloat64(variable.Value), true
+}
+
+// toFloat64 converts a SNMP numeric value to a float64. Unlike
+// ToBigInt(...).Int64(), Counter64 values above 2^63 don't overflow, and the
+// Opaque floats keep their fractional part.
+func toFloat64(value interface{}) float64 {
+	switch value := value.(type) {
+	case float32:
+		return float64(value)
+	case float64:
+		return value
+	}
+	f, _ := new(big.Float).SetInt(gosnmp.ToBigInt(value)).Float64()
+	return f
+}
@@ -0,0 +1,661 @@
+// Copyright (C) 2016 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugins
+
+import (
+	"context"
+	"math"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/soniah/gosnmp"
+)
+
+func TestSystemMetricsWithReorderedResponse(t *testing.T) {
+	// Agents may answer in any order: the values must match their OID,
+	// not their position in the request.
+	result := &gosnmp.SnmpPacket{
+		Variables: []gosnmp.SnmpPDU{
+			{Name: ".1.3.6.1.2.1.1.3.0", Type: gosnmp.TimeTicks, Value: 12345},
+			{Name: ".1.3.6.1.4.1.6574.1.5.4.0", Type: gosnmp.Integer, Value: 2},
+			{Name: ".1.3.6.1.4.1.6574.1.4.2.0", Type: gosnmp.Integer, Value: 1},
+			{Name: ".1.3.6.1.4.1.6574.1.4.1.0", Type: gosnmp.Integer, Value: 2},
+			{Name: ".1.3.6.1.4.1.6574.1.3.0", Type: gosnmp.Integer, Value: 1},
+			{Name: ".1.3.6.1.4.1.6574.1.2.0", Type: gosnmp.Integer, Value: 42},
+			{Name: ".1.3.6.1.4.1.6574.1.1.0", Type: gosnmp.Integer, Value: 1},
+		},
+	}
+	expected := &SystemMetrics{
+		Status:           float(1),
+		Temperature:      float(42),
+		PowerStatus:      float(1),
+		SystemFanStatus:  float(2),
+		CPUFanStatus:     float(1),
+		UpgradeAvailable: float(2),
+		Uptime:           float(123.45),
+		Fans:             map[string]float64{"1": 2},
+	}
+	metrics := SystemPlugin{}.Parse(variablesByOID(result))
+	if !reflect.DeepEqual(metrics, expected) {
+		t.Fatalf("Invalid metrics: %+v", metrics)
+	}
+}
+
+func TestLoadMetricsWithReorderedResponse(t *testing.T) {
+	result := &gosnmp.SnmpPacket{
+		Variables: []gosnmp.SnmpPDU{
+			{Name: ".1.3.6.1.4.1.2021.10.1.6.3", Type: gosnmp.OctetString, Value: []byte("0.30")},
+			{Name: "1.3.6.1.4.1.2021.10.1.6.1", Type: gosnmp.OctetString, Value: []byte("0.10")},
+			{Name: ".1.3.6.1.4.1.2021.10.1.6.2", Type: gosnmp.OctetString, Value: []byte("0.20")},
+		},
+	}
+	metrics := LoadPlugin{}.Parse(variablesByOID(result))
+	expected := &LoadMetrics{Short: float(0.1), Mid: float(0.2), Long: float(0.3)}
+	if !reflect.DeepEqual(metrics, expected) {
+		t.Fatalf("Invalid metrics: %+v", metrics)
+	}
+}
+
+func TestSystemMetricsWithNoSuchObject(t *testing.T) {
+	// upgradeAvailable isn't supported by older DSM
+	result := &gosnmp.SnmpPacket{
+		Variables: []gosnmp.SnmpPDU{
+			{Name: ".1.3.6.1.4.1.6574.1.1.0", Type: gosnmp.Integer, Value: 1},
+			{Name: ".1.3.6.1.4.1.6574.1.2.0", Type: gosnmp.Integer, Value: 42},
+			{Name: ".1.3.6.1.4.1.6574.1.3.0", Type: gosnmp.Integer, Value: 1},
+			{Name: ".1.3.6.1.4.1.6574.1.4.1.0", Type: gosnmp.Integer, Value: 1},
+			{Name: ".1.3.6.1.4.1.6574.1.4.2.0", Type: gosnmp.NoSuchInstance},
+			{Name: ".1.3.6.1.4.1.6574.1.5.4.0", Type: gosnmp.NoSuchObject},
+			{Name: ".1.3.6.1.2.1.1.3.0", Type: gosnmp.TimeTicks, Value: 100},
+		},
+	}
+	metrics := SystemPlugin{}.Parse(variablesByOID(result))
+	if metrics.UpgradeAvailable != nil || metrics.CPUFanStatus != nil {
+		t.Fatalf("Unsupported metrics reported: %+v", metrics)
+	}
+	if *metrics.Temperature != 42 || *metrics.Uptime != 1 {
+		t.Fatalf("Invalid metrics: %+v", metrics)
+	}
+}
+
+// ber encodes a BER type-length-value
+func ber(tag byte, values ...[]byte) []byte {
+	var value []byte
+	for _, v := range values {
+		value = append(value, v...)
+	}
+	if len(value) < 0x80 {
+		return append([]byte{tag, byte(len(value))}, value...)
+	}
+	return append([]byte{tag, 0x81, byte(len(value))}, value...)
+}
+
+// readTLV decodes the short form BER type-length-value at the start of
+// data
+func readTLV(data []byte) (value []byte, rest []byte) {
+	length := int(data[1])
+	return data[2 : 2+length], data[2+length:]
+}
+
+// serveResponse answers the first request received with the given
+// SNMPv2c response varbind.
+func serveResponse(t *testing.T, varbind []byte) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("Can't listen: %s", err)
+	}
+	go func() {
+		buf := make([]byte, 1500)
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		message, _ := readTLV(buf[:n])
+		_, rest := readTLV(message)
+		_, rest = readTLV(rest)
+		pdu, _ := readTLV(rest)
+		requestID, _ := readTLV(pdu)
+		response := ber(0x30,
+			ber(gosnmp.Integer, []byte{1}),
+			ber(gosnmp.OctetString, []byte("public")),
+			ber(byte(gosnmp.GetResponse),
+				ber(gosnmp.Integer, requestID),
+				ber(gosnmp.Integer, []byte{0}),
+				ber(gosnmp.Integer, []byte{0}),
+				ber(0x30, varbind)))
+		conn.WriteToUDP(response, addr)
+	}()
+	return conn
+}
+
+func TestCounter64NearMaxInt64(t *testing.T) {
+	// ifHCInOctets.1 = 2^63 + 2^11: the 53 significant bits of a float64
+	// are all needed to keep it exact.
+	oid := ".1.3.6.1.2.1.31.1.1.1.6.1"
+	agent := serveResponse(t, ber(0x30,
+		ber(gosnmp.ObjectIdentifier, []byte{0x2b, 6, 1, 2, 1, 31, 1, 1, 1, 6, 1}),
+		ber(gosnmp.Counter64, []byte{0, 0x80, 0, 0, 0, 0, 0, 0x08, 0})))
+	defer agent.Close()
+
+	snmp := &gosnmp.GoSNMP{
+		Target:    "127.0.0.1",
+		Port:      uint16(agent.LocalAddr().(*net.UDPAddr).Port),
+		Community: "public",
+		Version:   gosnmp.Version2c,
+		Timeout:   time.Second,
+	}
+	if err := snmp.Connect(); err != nil {
+		t.Fatalf("Can't connect: %s", err)
+	}
+	defer snmp.Conn.Close()
+	result, err := snmp.Get([]string{oid})
+	if err != nil {
+		t.Fatalf("SNMP Error: %s", err)
+	}
+
+	variable := variablesByOID(result)[oid]
+	if variable.Type != gosnmp.Counter64 {
+		t.Fatalf("Invalid type: %v", variable.Type)
+	}
+	if value := gosnmp.ToBigInt(variable.Value).String(); value != "9223372036854777856" {
+		t.Fatalf("Invalid big.Int value: %s", value)
+	}
+	value, ok := numericValue(variable)
+	if !ok || value != 1<<63+1<<11 {
+		t.Fatalf("Invalid float64 value: %f", value)
+	}
+}
+
+func TestDiskInfosWithExpansionUnit(t *testing.T) {
+	pdu := func(value string) gosnmp.SnmpPDU {
+		return gosnmp.SnmpPDU{Type: gosnmp.OctetString, Value: []byte(value)}
+	}
+	ids := map[string]gosnmp.SnmpPDU{
+		"0": pdu("Disk 1"),
+		"1": pdu("Disk 2"),
+		"2": pdu("DX517-1 Disk 1"),
+		"3": pdu("DX517-2 Disk 3"),
+	}
+	models := map[string]gosnmp.SnmpPDU{
+		"0": pdu("WD40EFRX-68N32N0       "),
+		"1": pdu("WD40EFRX-68N32N0"),
+		"2": pdu("ST4000VN008-2DR166"),
+		"3": pdu("ST4000VN008-2DR166"),
+	}
+	expected := map[string]*DiskInfo{
+		"0": {ID: "Disk 1", Model: "WD40EFRX-68N32N0", Enclosure: "main"},
+		"1": {ID: "Disk 2", Model: "WD40EFRX-68N32N0", Enclosure: "main"},
+		"2": {ID: "DX517-1 Disk 1", Model: "ST4000VN008-2DR166", Enclosure: "DX517-1"},
+		"3": {ID: "DX517-2 Disk 3", Model: "ST4000VN008-2DR166", Enclosure: "DX517-2"},
+	}
+	infos := parseDiskInfos(ids, models)
+	if len(infos) != len(expected) {
+		t.Fatalf("Invalid disks: %v", infos)
+	}
+	for index, info := range expected {
+		if !reflect.DeepEqual(infos[index], info) {
+			t.Fatalf("Invalid info for disk %s: %+v", index, infos[index])
+		}
+	}
+}
+
+func TestLoadMetricsWithShortResponse(t *testing.T) {
+	// laLoadFloat.3 is missing from the response
+	agent := serveResponse(t, append(
+		ber(0x30,
+			ber(gosnmp.ObjectIdentifier, []byte{0x2b, 6, 1, 4, 1, 0x8f, 0x65, 10, 1, 6, 1}),
+			ber(gosnmp.OctetString, []byte("0.12"))),
+		ber(0x30,
+			ber(gosnmp.ObjectIdentifier, []byte{0x2b, 6, 1, 4, 1, 0x8f, 0x65, 10, 1, 6, 2}),
+			ber(gosnmp.OctetString, []byte("0.25")))...))
+	defer agent.Close()
+
+	snmp := &gosnmp.GoSNMP{
+		Target:    "127.0.0.1",
+		Port:      uint16(agent.LocalAddr().(*net.UDPAddr).Port),
+		Community: "public",
+		Version:   gosnmp.Version2c,
+		Timeout:   time.Second,
+	}
+	if err := snmp.Connect(); err != nil {
+		t.Fatalf("Can't connect: %s", err)
+	}
+	defer snmp.Conn.Close()
+	metrics, err := LoadPlugin{}.Fetch(context.Background(), NewSession(snmp))
+	if err == nil {
+		t.Fatalf("No error for a short response: %v", metrics)
+	}
+	if !strings.Contains(err.Error(), "missing .1.3.6.1.4.1.2021.10.1.6.3") {
+		t.Fatalf("Missing OID not reported: %s", err)
+	}
+}
+
+// mockSNMP is a SNMPGetter answering with canned variables, in their order
+type mockSNMP struct {
+	version   gosnmp.SnmpVersion
+	variables []gosnmp.SnmpPDU
+}
+
+func (m mockSNMP) SNMPVersion() gosnmp.SnmpVersion {
+	return m.version
+}
+
+func (m mockSNMP) Get(oids []string) (*gosnmp.SnmpPacket, error) {
+	result := &gosnmp.SnmpPacket{}
+	for _, oid := range oids {
+		variable := gosnmp.SnmpPDU{Name: oid, Type: gosnmp.NoSuchObject}
+		for _, v := range m.variables {
+			if v.Name == oid {
+				variable = v
+			}
+		}
+		result.Variables = append(result.Variables, variable)
+	}
+	return result, nil
+}
+
+func (m mockSNMP) Walk(oid string) ([]gosnmp.SnmpPDU, error) {
+	var variables []gosnmp.SnmpPDU
+	for _, v := range m.variables {
+		if strings.HasPrefix(v.Name, oid+".") {
+			variables = append(variables, v)
+		}
+	}
+	return variables, nil
+}
+
+func integer(oid string, value int) gosnmp.SnmpPDU {
+	return gosnmp.SnmpPDU{Name: oid, Type: gosnmp.Integer, Value: value}
+}
+
+func counter32(oid string, value uint) gosnmp.SnmpPDU {
+	return gosnmp.SnmpPDU{Name: oid, Type: gosnmp.Counter32, Value: value}
+}
+
+func counter64(oid string, value uint64) gosnmp.SnmpPDU {
+	return gosnmp.SnmpPDU{Name: oid, Type: gosnmp.Counter64, Value: value}
+}
+
+func octetString(oid string, value string) gosnmp.SnmpPDU {
+	return gosnmp.SnmpPDU{Name: oid, Type: gosnmp.OctetString, Value: []byte(value)}
+}
+
+// float returns a pointer to the value, as the optional metrics
+func float(value float64) *float64 {
+	return &value
+}
+
+// fetchFunc is the Fetch method of a plugin, in the tables of plugins
+// fetching different metrics
+type fetchFunc func(ctx context.Context, snmp SNMPGetter) (interface{}, error)
+
+func fetch[M any](plugin Fetcher[M]) fetchFunc {
+	return func(ctx context.Context, snmp SNMPGetter) (interface{}, error) {
+		return plugin.Fetch(ctx, snmp)
+	}
+}
+
+func TestPluginsFetch(t *testing.T) {
+	interfaces := []gosnmp.SnmpPDU{
+		octetString(".1.3.6.1.2.1.2.2.1.2.1", "lo"),
+		octetString(".1.3.6.1.2.1.2.2.1.2.2", "eth0"),
+		integer(".1.3.6.1.2.1.2.2.1.3.1", 24),
+		integer(".1.3.6.1.2.1.2.2.1.3.2", 6),
+		counter32(".1.3.6.1.2.1.2.2.1.10.1", 500),
+		counter32(".1.3.6.1.2.1.2.2.1.10.2", 1000),
+		counter32(".1.3.6.1.2.1.2.2.1.14.2", 4),
+		counter32(".1.3.6.1.2.1.2.2.1.16.1", 500),
+		counter32(".1.3.6.1.2.1.2.2.1.16.2", 2000),
+		counter64(".1.3.6.1.2.1.31.1.1.1.6.1", 500),
+		counter64(".1.3.6.1.2.1.31.1.1.1.6.2", 1<<40),
+		counter64(".1.3.6.1.2.1.31.1.1.1.10.1", 500),
+		counter64(".1.3.6.1.2.1.31.1.1.1.10.2", 1<<41),
+	}
+	cpu := []gosnmp.SnmpPDU{
+		counter32(".1.3.6.1.4.1.2021.11.50.0", 1000),
+		counter32(".1.3.6.1.4.1.2021.11.53.0", 9000),
+		integer(".1.3.6.1.2.1.25.3.3.1.2.196608", 10),
+		integer(".1.3.6.1.2.1.25.3.3.1.2.196609", 20),
+	}
+	tests := []struct {
+		name      string
+		fetch     fetchFunc
+		version   gosnmp.SnmpVersion
+		variables []gosnmp.SnmpPDU
+		expected  interface{}
+	}{
+		{
+			name:  "memory",
+			fetch: fetch(MemoryPlugin{}),
+			variables: []gosnmp.SnmpPDU{
+				integer(".1.3.6.1.4.1.2021.4.5.0", 1000),
+				integer(".1.3.6.1.4.1.2021.4.6.0", 100),
+			},
+			expected: &MemoryMetrics{
+				TotalReal: float(1024000),
+				AvailReal: float(102400),
+			},
+		},
+		{
+			name:  "load",
+			fetch: fetch(LoadPlugin{}),
+			variables: []gosnmp.SnmpPDU{
+				octetString(".1.3.6.1.4.1.2021.10.1.6.1", "0.12"),
+				octetString(".1.3.6.1.4.1.2021.10.1.6.2", "0.25"),
+				octetString(".1.3.6.1.4.1.2021.10.1.6.3", "0.37"),
+			},
+			expected: &LoadMetrics{Short: float(0.12), Mid: float(0.25), Long: float(0.37)},
+		},
+		{
+			name:      "cpu",
+			fetch:     fetch(CPUPlugin{}),
+			variables: cpu,
+			expected:  &CPUMetrics{User: float(1000), Idle: float(9000)},
+		},
+		{
+			name:      "cpu per core",
+			fetch:     fetch(CPUPlugin{PerCore: true}),
+			variables: cpu,
+			expected: &CPUMetrics{
+				User:  float(1000),
+				Idle:  float(9000),
+				Cores: map[int]float64{0: 10, 1: 20},
+			},
+		},
+		{
+			name:      "net with SNMPv1",
+			fetch:     fetch(NetworkPlugin{}),
+			version:   gosnmp.Version1,
+			variables: interfaces,
+			expected:  &NetworkMetrics{In: 1000, Out: 2000},
+		},
+		{
+			name:      "net per interface",
+			fetch:     fetch(NetworkPlugin{PerInterface: true}),
+			version:   gosnmp.Version2c,
+			variables: interfaces,
+			expected: &NetworkMetrics{
+				In:  1 << 40,
+				Out: 1 << 41,
+				Interfaces: map[string]*InterfaceMetrics{
+					"eth0": {InOctets: float(1 << 40), OutOctets: float(1 << 41), InErrors: float(4)},
+				},
+			},
+		},
+		{
+			name:  "disk",
+			fetch: fetch(DiskPlugin{}),
+			variables: []gosnmp.SnmpPDU{
+				octetString(".1.3.6.1.4.1.6574.2.1.1.2.0", "Disk 1"),
+				octetString(".1.3.6.1.4.1.6574.2.1.1.2.1", "Disk 2"),
+				octetString(".1.3.6.1.4.1.6574.2.1.1.3.0", "WD40EFRX"),
+				octetString(".1.3.6.1.4.1.6574.2.1.1.3.1", "WD40EFRX"),
+				integer(".1.3.6.1.4.1.6574.2.1.1.6.0", 35),
+				integer(".1.3.6.1.4.1.6574.2.1.1.6.1", 37),
+				integer(".1.3.6.1.4.1.6574.2.1.1.9.0", 0),
+				integer(".1.3.6.1.4.1.6574.2.1.1.9.1", 12),
+			},
+			expected: &DiskMetrics{Disks: map[string]*Disk{
+				"0": {
+					Info:        &DiskInfo{ID: "Disk 1", Model: "WD40EFRX", Enclosure: "main"},
+					Temperature: float(35),
+					BadSectors:  float(0),
+				},
+				"1": {
+					Info:        &DiskInfo{ID: "Disk 2", Model: "WD40EFRX", Enclosure: "main"},
+					Temperature: float(37),
+					BadSectors:  float(12),
+				},
+			}},
+		},
+		{
+			name:  "service",
+			fetch: fetch(ServicePlugin{}),
+			variables: []gosnmp.SnmpPDU{
+				octetString(".1.3.6.1.4.1.6574.6.1.1.2.1", "CIFS"),
+				octetString(".1.3.6.1.4.1.6574.6.1.1.2.2", "AFP"),
+				integer(".1.3.6.1.4.1.6574.6.1.1.3.1", 3),
+				integer(".1.3.6.1.4.1.6574.6.1.1.3.2", 0),
+			},
+			expected: &ServiceMetrics{
+				Connections: map[string]float64{"CIFS": 3, "AFP": 0},
+				SMB:         float(3),
+				AFP:         float(0),
+			},
+		},
+	}
+	for _, test := range tests {
+		snmp := mockSNMP{version: test.version, variables: test.variables}
+		metrics, err := test.fetch(context.Background(), snmp)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if !reflect.DeepEqual(metrics, test.expected) {
+			t.Fatalf("%s: invalid metrics: %+v", test.name, metrics)
+		}
+	}
+}
+
+func TestSystemMetricsWithSeveralFans(t *testing.T) {
+	snmp := mockSNMP{variables: []gosnmp.SnmpPDU{
+		integer(".1.3.6.1.4.1.6574.1.1.0", 1),
+		integer(".1.3.6.1.4.1.6574.1.4.1.1", 1),
+		integer(".1.3.6.1.4.1.6574.1.4.1.2", 2),
+		integer(".1.3.6.1.4.1.6574.1.4.2.0", 1),
+	}}
+	plugin := SystemPlugin{}
+	if metrics := plugin.Parse(variablesByOID(&gosnmp.SnmpPacket{Variables: snmp.variables})); metrics != nil {
+		t.Fatalf("Fans status parsed without walking them: %v", metrics)
+	}
+	metrics, err := plugin.Fetch(context.Background(), snmp)
+	if err != nil {
+		t.Fatalf("Can't fetch system metrics: %s", err)
+	}
+	expected := &SystemMetrics{
+		Status:       float(1),
+		CPUFanStatus: float(1),
+		Fans:         map[string]float64{"1": 1, "2": 2},
+	}
+	if !reflect.DeepEqual(metrics, expected) {
+		t.Fatalf("Invalid metrics: %+v", metrics)
+	}
+}
+
+// v1SNMP is a SNMPv1 mockSNMP: a Get request with a missing OID fails with
+// noSuchName, and its variables are returned unset.
+type v1SNMP struct {
+	mockSNMP
+}
+
+func (m v1SNMP) Get(oids []string) (*gosnmp.SnmpPacket, error) {
+	result, _ := m.mockSNMP.Get(oids)
+	for i, variable := range result.Variables {
+		if variable.Type == gosnmp.NoSuchObject {
+			result.Error, result.ErrorIndex = gosnmp.NoSuchName, uint8(i+1)
+		}
+	}
+	if result.Error != gosnmp.NoError {
+		for i := range result.Variables {
+			result.Variables[i] = gosnmp.SnmpPDU{Name: oids[i], Type: gosnmp.Null}
+		}
+	}
+	return result, nil
+}
+
+func TestSystemMetricsWithoutUpgradeAvailable(t *testing.T) {
+	// upgradeAvailable isn't supported by older DSM
+	snmp := v1SNMP{mockSNMP{version: gosnmp.Version1, variables: []gosnmp.SnmpPDU{
+		integer(".1.3.6.1.4.1.6574.1.1.0", 1),
+		integer(".1.3.6.1.4.1.6574.1.2.0", 42),
+		integer(".1.3.6.1.4.1.6574.1.3.0", 1),
+		integer(".1.3.6.1.4.1.6574.1.4.1.0", 1),
+		integer(".1.3.6.1.4.1.6574.1.4.2.0", 1),
+		{Name: ".1.3.6.1.2.1.1.3.0", Type: gosnmp.TimeTicks, Value: 100},
+	}}}
+	metrics, err := SystemPlugin{}.Fetch(context.Background(), snmp)
+	if err != nil {
+		t.Fatalf("Can't fetch system metrics: %s", err)
+	}
+	expected := &SystemMetrics{
+		Status:          float(1),
+		Temperature:     float(42),
+		PowerStatus:     float(1),
+		SystemFanStatus: float(1),
+		CPUFanStatus:    float(1),
+		Uptime:          float(1),
+		Fans:            map[string]float64{"1": 1},
+	}
+	if !reflect.DeepEqual(metrics, expected) {
+		t.Fatalf("Invalid metrics: %+v", metrics)
+	}
+}
+
+func TestDiskTemperaturesWithStrings(t *testing.T) {
+	snmp := mockSNMP{variables: []gosnmp.SnmpPDU{
+		integer(".1.3.6.1.4.1.6574.2.1.1.6.0", 35),
+		octetString(".1.3.6.1.4.1.6574.2.1.1.6.1", "42 "),
+		octetString(".1.3.6.1.4.1.6574.2.1.1.6.2", "n/a"),
+	}}
+	temperatures, err := DiskPlugin{}.getTemperatures(context.Background(), snmp)
+	if err != nil {
+		t.Fatalf("Can't get the temperatures: %s", err)
+	}
+	expected := map[string]float64{"0": 35, "1": 42}
+	if !reflect.DeepEqual(temperatures, expected) {
+		t.Fatalf("Invalid temperatures: %v", temperatures)
+	}
+}
+
+func TestOpaqueFloat(t *testing.T) {
+	// laLoadFloat.1 = 0.73, as Net-SNMP sends it: an Opaque wrapping the
+	// 0x9f 0x78 float tag and the IEEE 754 value.
+	oid := ".1.3.6.1.4.1.2021.10.1.6.1"
+	agent := serveResponse(t, ber(0x30,
+		ber(gosnmp.ObjectIdentifier, []byte{0x2b, 6, 1, 4, 1, 0x8f, 0x65, 10, 1, 6, 1}),
+		ber(gosnmp.Opaque, []byte{0x9f, gosnmp.OpaqueFloat, 4, 0x3f, 0x3a, 0xe1, 0x48})))
+	defer agent.Close()
+
+	snmp := &gosnmp.GoSNMP{
+		Target:    "127.0.0.1",
+		Port:      uint16(agent.LocalAddr().(*net.UDPAddr).Port),
+		Community: "public",
+		Version:   gosnmp.Version2c,
+		Timeout:   time.Second,
+	}
+	if err := snmp.Connect(); err != nil {
+		t.Fatalf("Can't connect: %s", err)
+	}
+	defer snmp.Conn.Close()
+	result, err := snmp.Get([]string{oid})
+	if err != nil {
+		t.Fatalf("SNMP Error: %s", err)
+	}
+
+	variable := variablesByOID(result)[oid]
+	if variable.Type != gosnmp.OpaqueFloat {
+		t.Fatalf("Invalid type: %v", variable.Type)
+	}
+	value, ok := numericValue(variable)
+	if !ok || math.Abs(value-0.73) > 1e-6 {
+		t.Fatalf("Invalid float64 value: %f", value)
+	}
+}
+
+func TestLoadMetricsParse(t *testing.T) {
+	metrics := LoadPlugin{}.Parse(map[string]gosnmp.SnmpPDU{
+		".1.3.6.1.4.1.2021.10.1.6.1": {Type: gosnmp.OctetString, Value: []byte("0.73")},
+		".1.3.6.1.4.1.2021.10.1.6.2": {Type: gosnmp.OpaqueFloat, Value: float32(1.5)},
+		".1.3.6.1.4.1.2021.10.1.6.3": {Type: gosnmp.OctetString, Value: []byte("n/a")},
+	})
+	expected := &LoadMetrics{Short: float(0.73), Mid: float(1.5)}
+	if !reflect.DeepEqual(metrics, expected) {
+		t.Fatalf("Invalid load metrics: %+v", metrics)
+	}
+}
+
+func TestFanSpeed(t *testing.T) {
+	// entPhySensorValue.3 = 1500 RPM, an Integer32 spanning 2 bytes
+	oid := ".1.3.6.1.2.1.99.1.1.1.4.3"
+	agent := serveResponse(t, ber(0x30,
+		ber(gosnmp.ObjectIdentifier, []byte{0x2b, 6, 1, 2, 1, 99, 1, 1, 1, 4, 3}),
+		ber(gosnmp.Integer, []byte{0x05, 0xdc})))
+	defer agent.Close()
+
+	snmp := &gosnmp.GoSNMP{
+		Target:    "127.0.0.1",
+		Port:      uint16(agent.LocalAddr().(*net.UDPAddr).Port),
+		Community: "public",
+		Version:   gosnmp.Version2c,
+		Timeout:   time.Second,
+	}
+	if err := snmp.Connect(); err != nil {
+		t.Fatalf("Can't connect: %s", err)
+	}
+	defer snmp.Conn.Close()
+	result, err := snmp.Get([]string{oid})
+	if err != nil {
+		t.Fatalf("SNMP Error: %s", err)
+	}
+	value, ok := numericValue(variablesByOID(result)[oid])
+	if !ok || value != 1500 {
+		t.Fatalf("Invalid sensor value: %f", value)
+	}
+
+	// A kilo RPM sensor with 3 decimal places, and one which isn't a fan
+	speeds, err := getFanSpeeds(context.Background(), mockSNMP{variables: []gosnmp.SnmpPDU{
+		integer(".1.3.6.1.2.1.99.1.1.1.1.3", sensorTypeRPM),
+		integer(".1.3.6.1.2.1.99.1.1.1.1.4", sensorTypeRPM),
+		integer(".1.3.6.1.2.1.99.1.1.1.1.5", 8),
+		integer(".1.3.6.1.2.1.99.1.1.1.2.3", sensorScaleUnits),
+		integer(".1.3.6.1.2.1.99.1.1.1.2.4", 10),
+		integer(".1.3.6.1.2.1.99.1.1.1.3.4", 3),
+		integer(".1.3.6.1.2.1.99.1.1.1.4.3", 1500),
+		integer(".1.3.6.1.2.1.99.1.1.1.4.4", 1200),
+		integer(".1.3.6.1.2.1.99.1.1.1.4.5", 42),
+		octetString(".1.3.6.1.2.1.47.1.1.1.1.7.3", "Fan 1"),
+	}})
+	if err != nil {
+		t.Fatalf("Can't get the fans speed: %s", err)
+	}
+	expected := map[string]float64{"Fan 1": 1500, "4": 1200}
+	if !reflect.DeepEqual(speeds, expected) {
+		t.Fatalf("Invalid fans speed: %v", speeds)
+	}
+}
+
+func TestDateAndTime(t *testing.T) {
+	// 2026-10-16 11:30:42.5 +02:00
+	date, ok := dateAndTime(gosnmp.SnmpPDU{Type: gosnmp.OctetString,
+		Value: []byte{0x07, 0xea, 10, 16, 11, 30, 42, 5, '+', 2, 0}})
+	if !ok {
+		t.Fatalf("Date not decoded")
+	}
+	if expected := time.Date(2026, 10, 16, 9, 30, 42, 5e8, time.UTC); !date.Equal(expected) {
+		t.Fatalf("Invalid date: %s", date)
+	}
+	// Without time zone
+	if date, ok := dateAndTime(gosnmp.SnmpPDU{Type: gosnmp.OctetString,
+		Value: []byte{0x07, 0xea, 10, 16, 11, 30, 42, 5}}); ok {
+		t.Fatalf("Date without time zone decoded: %s", date)
+	}
+	// Month 13
+	if date, ok := dateAndTime(gosnmp.SnmpPDU{Type: gosnmp.OctetString,
+		Value: []byte{0x07, 0xea, 13, 16, 11, 30, 42, 5, '-', 5, 0}}); ok {
+		t.Fatalf("Invalid date decoded: %s", date)
+	}
+}
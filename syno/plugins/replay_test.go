@@ -0,0 +1,257 @@
+// Copyright (C) 2016 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugins
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/soniah/gosnmp"
+)
+
+// The captures of testdata are replayed through the gosnmp decoding and the
+// plugins. A capture of the exporter with SNMPv1 or v2c, e.g. taken with
+//
+//     tcpdump -i eth0 -w diskstation.pcap udp port 161
+//
+// may be added with the metrics it must give. The current ones are synthetic,
+// not captured from a Diskstation: their responses were generated with the
+// layouts of a DS218+ (synthetic-two-disks.pcap) and of a DS1817+ with a DX517
+// expansion unit and two system fans (synthetic-expansion-unit.pcap).
+
+// pcap link types
+const (
+	linkTypeEthernet = 1
+	linkTypeLinuxSLL = 113
+)
+
+// readPcap returns the UDP payloads sent from the SNMP port in a pcap file,
+// i.e. the messages of the agent. The Ethernet and Linux cooked (tcpdump -i
+// any) captures of IPv4 and IPv6 are supported.
+func readPcap(path string) ([][]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 24 {
+		return nil, fmt.Errorf("Invalid pcap header")
+	}
+	var order binary.ByteOrder
+	switch binary.LittleEndian.Uint32(data) {
+	case 0xa1b2c3d4, 0xa1b23c4d:
+		order = binary.LittleEndian
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("Not a pcap file")
+	}
+	linkType := order.Uint32(data[20:])
+	var payloads [][]byte
+	for rest := data[24:]; len(rest) > 0; {
+		if len(rest) < 16 {
+			return nil, fmt.Errorf("Truncated pcap record")
+		}
+		length := int(order.Uint32(rest[8:]))
+		if len(rest) < 16+length {
+			return nil, fmt.Errorf("Truncated pcap record")
+		}
+		payload, err := snmpPayload(linkType, rest[16:16+length])
+		if err != nil {
+			return nil, err
+		}
+		if payload != nil {
+			payloads = append(payloads, payload)
+		}
+		rest = rest[16+length:]
+	}
+	return payloads, nil
+}
+
+// snmpPayload returns the UDP payload of the frame if it's sent from the
+// SNMP port, or nil.
+func snmpPayload(linkType uint32, frame []byte) ([]byte, error) {
+	var etherType uint16
+	switch linkType {
+	case linkTypeEthernet:
+		if len(frame) < 14 {
+			return nil, fmt.Errorf("Truncated Ethernet frame")
+		}
+		etherType, frame = binary.BigEndian.Uint16(frame[12:]), frame[14:]
+		if etherType == 0x8100 && len(frame) >= 4 {
+			// 802.1Q VLAN tag
+			etherType, frame = binary.BigEndian.Uint16(frame[2:]), frame[4:]
+		}
+	case linkTypeLinuxSLL:
+		if len(frame) < 16 {
+			return nil, fmt.Errorf("Truncated Linux cooked frame")
+		}
+		etherType, frame = binary.BigEndian.Uint16(frame[14:]), frame[16:]
+	default:
+		return nil, fmt.Errorf("Unsupported pcap link type %d", linkType)
+	}
+	var udp []byte
+	switch {
+	case etherType == 0x0800 && len(frame) >= 20 && frame[9] == 17:
+		udp = frame[int(frame[0]&0x0f)*4:]
+	case etherType == 0x86dd && len(frame) >= 40 && frame[6] == 17:
+		udp = frame[40:]
+	default:
+		return nil, nil
+	}
+	if len(udp) < 8 || binary.BigEndian.Uint16(udp) != 161 {
+		return nil, nil
+	}
+	return udp[8:binary.BigEndian.Uint16(udp[4:])], nil
+}
+
+// replay returns a SNMPGetter answering with the variables of the responses
+// of a capture
+func replay(t *testing.T, capture string) mockSNMP {
+	payloads, err := readPcap(filepath.Join("testdata", capture))
+	if err != nil {
+		t.Fatalf("Can't read %s: %s", capture, err)
+	}
+	decoder := &gosnmp.GoSNMP{}
+	variables := map[string]gosnmp.SnmpPDU{}
+	snmp := mockSNMP{}
+	for _, payload := range payloads {
+		packet, err := decoder.SnmpDecodePacket(payload)
+		if err != nil {
+			t.Fatalf("Can't decode a message of %s: %s", capture, err)
+		}
+		if packet.PDUType != gosnmp.GetResponse {
+			continue
+		}
+		snmp.version = packet.Version
+		for _, variable := range packet.Variables {
+			variables[variable.Name] = variable
+		}
+	}
+	for _, variable := range variables {
+		snmp.variables = append(snmp.variables, variable)
+	}
+	sort.Slice(snmp.variables, func(i, j int) bool {
+		return oidLess(snmp.variables[i].Name, snmp.variables[j].Name)
+	})
+	return snmp
+}
+
+// oidLess compares two OIDs in the lexicographic order of their arcs, as in
+// the walks
+func oidLess(a string, b string) bool {
+	arcsA := strings.Split(strings.TrimPrefix(a, "."), ".")
+	arcsB := strings.Split(strings.TrimPrefix(b, "."), ".")
+	for i := 0; i < len(arcsA) && i < len(arcsB); i++ {
+		x, _ := strconv.ParseUint(arcsA[i], 10, 64)
+		y, _ := strconv.ParseUint(arcsB[i], 10, 64)
+		if x != y {
+			return x < y
+		}
+	}
+	return len(arcsA) < len(arcsB)
+}
+
+// disk returns the metrics of a disk of the captures, without bad sectors
+func disk(id string, model string, enclosure string, temperature float64) *Disk {
+	return &Disk{
+		Info:        &DiskInfo{ID: id, Model: model, Enclosure: enclosure},
+		Temperature: float(temperature),
+		BadSectors:  float(0),
+	}
+}
+
+func TestReplayCaptures(t *testing.T) {
+	expansion := &DiskMetrics{Disks: map[string]*Disk{}}
+	for i := 0; i < 8; i++ {
+		expansion.Disks[strconv.Itoa(i)] = disk(fmt.Sprintf("Disk %d", i+1), "ST8000VN004-2M2101", "main", float64(38+i%3))
+	}
+	expansion.Disks["3"].BadSectors = float(12)
+	for i := 0; i < 5; i++ {
+		expansion.Disks[strconv.Itoa(8+i)] = disk(fmt.Sprintf("DX517-1 Disk %d", i+1), "HAT5300-8T", "DX517-1", float64(33+i%2))
+	}
+
+	for _, capture := range []struct {
+		file    string
+		system  *SystemMetrics
+		disks   *DiskMetrics
+		volumes *SpaceMetrics
+	}{
+		{
+			file: "synthetic-two-disks.pcap",
+			system: &SystemMetrics{
+				Status:           float(1),
+				Temperature:      float(41),
+				PowerStatus:      float(1),
+				SystemFanStatus:  float(1),
+				CPUFanStatus:     float(1),
+				UpgradeAvailable: float(UpgradeUnavailable),
+				Uptime:           float(8640000),
+				Fans:             map[string]float64{"1": 1},
+			},
+			disks: &DiskMetrics{Disks: map[string]*Disk{
+				"0": disk("Disk 1", "WD40EFRX-68N32N0", "main", 34),
+				"1": disk("Disk 2", "WD40EFRX-68N32N0", "main", 36),
+			}},
+			volumes: &SpaceMetrics{Volumes: map[string]*Volume{
+				"Volume 1": {Free: float(1795467370496), Total: float(3835160870912)},
+			}},
+		},
+		{
+			file: "synthetic-expansion-unit.pcap",
+			system: &SystemMetrics{
+				Status:           float(1),
+				Temperature:      float(45),
+				PowerStatus:      float(1),
+				CPUFanStatus:     float(1),
+				UpgradeAvailable: float(UpgradeAvailable),
+				// TimeTicks above 2^31
+				Uptime: float(30000000),
+				Fans:   map[string]float64{"1": 1, "2": 2},
+			},
+			disks: expansion,
+			volumes: &SpaceMetrics{Volumes: map[string]*Volume{
+				"Volume 1": {Free: float(20938574151680), Total: float(46766603108352)},
+				"Volume 2": {Free: float(35184372088832), Total: float(39983021322240)},
+			}},
+		},
+	} {
+		snmp := replay(t, capture.file)
+		for _, plugin := range []struct {
+			name     string
+			fetch    fetchFunc
+			expected interface{}
+		}{
+			{"system", fetch(SystemPlugin{}), capture.system},
+			{"disk", fetch(DiskPlugin{}), capture.disks},
+			{"space", fetch(SpacePlugin{}), capture.volumes},
+		} {
+			metrics, err := plugin.fetch(context.Background(), snmp)
+			if err != nil {
+				t.Fatalf("%s: %s plugin failed: %s", capture.file, plugin.name, err)
+			}
+			if !reflect.DeepEqual(metrics, plugin.expected) {
+				t.Errorf("%s: invalid %s metrics: %+v", capture.file, plugin.name, metrics)
+			}
+		}
+	}
+}
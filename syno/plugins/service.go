@@ -0,0 +1,95 @@
+// Copyright (C) 2016 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugins
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/common/log"
+)
+
+var (
+	// serviceTable from SYNOLOGY-SERVICES-MIB
+	serviceBase     = ".1.3.6.1.4.1.6574.6"
+	oidServiceName  = ".1.3.6.1.4.1.6574.6.1.1.2" // serviceName
+	oidServiceUsers = ".1.3.6.1.4.1.6574.6.1.1.3" // serviceUsers
+)
+
+// ServiceMetrics are the number of connections to each service (CIFS, AFP,
+// ...), by name
+type ServiceMetrics struct {
+	Connections map[string]float64
+
+	// SMB, NFS and AFP are the connections of the file services, or nil
+	// when the service is disabled
+	SMB *float64
+	NFS *float64
+	AFP *float64
+}
+
+type ServicePlugin struct {
+	Base string
+}
+
+func (p ServicePlugin) Fetch(ctx context.Context, snmp SNMPGetter) (*ServiceMetrics, error) {
+	log.Debugf("[Service Plugin] Walk SNMP services")
+	names, err := walkTable(ctx, snmp, p.oid(oidServiceName))
+	if err != nil {
+		return nil, fmt.Errorf("[Service Plugin] SNMP Error: %v", err)
+	}
+	users, err := walkTable(ctx, snmp, p.oid(oidServiceUsers))
+	if err != nil {
+		return nil, fmt.Errorf("[Service Plugin] SNMP Error: %v", err)
+	}
+	metrics := &ServiceMetrics{Connections: map[string]float64{}}
+	for index, variable := range users {
+		value, ok := numericValue(variable)
+		if !ok {
+			continue
+		}
+		service := index
+		if name, ok := names[index].Value.([]byte); ok {
+			service = string(name)
+		}
+		metrics.Connections[service] = value
+		switch strings.ToUpper(service) {
+		case "CIFS", "SMB":
+			metrics.SMB = &value
+		case "NFS":
+			metrics.NFS = &value
+		case "AFP":
+			metrics.AFP = &value
+		}
+	}
+	return metrics, nil
+}
+
+// oid returns the OID of the column under Base
+func (p ServicePlugin) oid(column string) string {
+	return rebase(column, serviceBase, p.Base)
+}
+
+// DefaultBase implements Rebased
+func (p ServicePlugin) DefaultBase() string {
+	return serviceBase
+}
+
+// WithBase implements Rebased
+func (p ServicePlugin) WithBase(base string) Plugin {
+	p.Base = base
+	return p
+}
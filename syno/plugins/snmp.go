@@ -0,0 +1,59 @@
+// Copyright (C) 2016 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugins
+
+import (
+	"github.com/soniah/gosnmp"
+)
+
+// SNMPGetter is the SNMP session the plugins send their requests on
+type SNMPGetter interface {
+	// SNMPVersion returns the version of the SNMP protocol of the session
+	SNMPVersion() gosnmp.SnmpVersion
+
+	// Get retrieves the values of the OIDs
+	Get(oids []string) (*gosnmp.SnmpPacket, error)
+
+	// Walk retrieves the subtree of the OID
+	Walk(oid string) ([]gosnmp.SnmpPDU, error)
+}
+
+// NewSession returns the SNMPGetter sending the requests of the plugins on a
+// gosnmp session.
+func NewSession(snmp *gosnmp.GoSNMP) SNMPGetter {
+	return session{snmp: snmp}
+}
+
+type session struct {
+	snmp *gosnmp.GoSNMP
+}
+
+func (s session) SNMPVersion() gosnmp.SnmpVersion {
+	return s.snmp.Version
+}
+
+func (s session) Get(oids []string) (*gosnmp.SnmpPacket, error) {
+	return s.snmp.Get(oids)
+}
+
+// Walk retrieves the subtree with GetBulk requests of MaxRepetitions values
+// with SNMPv2c and v3. SNMPv1 has no GetBulk, so one GetNext request is sent
+// per value.
+func (s session) Walk(oid string) ([]gosnmp.SnmpPDU, error) {
+	if s.snmp.Version == gosnmp.Version1 {
+		return s.snmp.WalkAll(oid)
+	}
+	return s.snmp.BulkWalkAll(oid)
+}
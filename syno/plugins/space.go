@@ -0,0 +1,100 @@
+// Copyright (C) 2016 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugins
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/prometheus/common/log"
+)
+
+var (
+	// raidTable from SYNOLOGY-RAID-MIB, in bytes (DSM 6 and later)
+	spaceBase   = ".1.3.6.1.4.1.6574.3"
+	oidRaidName = ".1.3.6.1.4.1.6574.3.1.1.2" // raidName
+	spaceOIDs   = map[string]string{
+		"free":  ".1.3.6.1.4.1.6574.3.1.1.4", // raidFreeSize
+		"total": ".1.3.6.1.4.1.6574.3.1.1.5", // raidTotalSize
+	}
+)
+
+// SpaceMetrics are the volumes of the Diskstation, by name
+type SpaceMetrics struct {
+	Volumes map[string]*Volume
+}
+
+// Volume holds the sizes of a volume, in bytes. They are nil when the
+// Diskstation doesn't have them.
+type Volume struct {
+	Free  *float64
+	Total *float64
+}
+
+// SpacePlugin retrieves the free and total space of the Synology volumes
+type SpacePlugin struct {
+	Base string
+}
+
+func (p SpacePlugin) Fetch(ctx context.Context, snmp SNMPGetter) (*SpaceMetrics, error) {
+	log.Debugf("[Space Plugin] Walk SNMP volumes")
+	names, err := walkTable(ctx, snmp, p.oid(oidRaidName))
+	if err != nil {
+		return nil, fmt.Errorf("[Space Plugin] SNMP Error: %v", err)
+	}
+	metrics := &SpaceMetrics{Volumes: map[string]*Volume{}}
+	for name, oid := range spaceOIDs {
+		rows, err := walkTable(ctx, snmp, p.oid(oid))
+		if err != nil {
+			return nil, fmt.Errorf("[Space Plugin] SNMP Error: %v", err)
+		}
+		for index, variable := range rows {
+			value := numeric(variable)
+			if value == nil {
+				continue
+			}
+			volume := index
+			if names[index].Value != nil {
+				volume = stringValue(names[index])
+			}
+			if metrics.Volumes[volume] == nil {
+				metrics.Volumes[volume] = &Volume{}
+			}
+			switch name {
+			case "free":
+				metrics.Volumes[volume].Free = value
+			case "total":
+				metrics.Volumes[volume].Total = value
+			}
+		}
+	}
+	return metrics, nil
+}
+
+// oid returns the OID of the column under Base
+func (p SpacePlugin) oid(column string) string {
+	return rebase(column, spaceBase, p.Base)
+}
+
+// DefaultBase implements Rebased
+func (p SpacePlugin) DefaultBase() string {
+	return spaceBase
+}
+
+// WithBase implements Rebased
+func (p SpacePlugin) WithBase(base string) Plugin {
+	p.Base = base
+	return p
+}
@@ -0,0 +1,159 @@
+// Copyright (C) 2016 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugins
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/prometheus/common/log"
+	"github.com/soniah/gosnmp"
+)
+
+var (
+	// hrStorageTable from HOST-RESOURCES-MIB
+	oidStorageType            = ".1.3.6.1.2.1.25.2.3.1.2" // hrStorageType
+	oidStorageDescr           = ".1.3.6.1.2.1.25.2.3.1.3" // hrStorageDescr
+	oidStorageAllocationUnits = ".1.3.6.1.2.1.25.2.3.1.4" // hrStorageAllocationUnits
+	storageOIDs               = map[string]string{
+		"size": ".1.3.6.1.2.1.25.2.3.1.5", // hrStorageSize
+		"used": ".1.3.6.1.2.1.25.2.3.1.6", // hrStorageUsed
+	}
+
+	// hrFSTable from HOST-RESOURCES-MIB
+	oidFSType         = ".1.3.6.1.2.1.25.3.8.1.4" // hrFSType
+	oidFSStorageIndex = ".1.3.6.1.2.1.25.3.8.1.7" // hrFSStorageIndex
+
+	// hrStorageTypes from HOST-RESOURCES-TYPES
+	storageTypes = map[string]string{
+		".1.3.6.1.2.1.25.2.1.1":  "other",
+		".1.3.6.1.2.1.25.2.1.2":  "ram",
+		".1.3.6.1.2.1.25.2.1.3":  "virtual_memory",
+		".1.3.6.1.2.1.25.2.1.4":  "fixed_disk",
+		".1.3.6.1.2.1.25.2.1.5":  "removable_disk",
+		".1.3.6.1.2.1.25.2.1.6":  "floppy_disk",
+		".1.3.6.1.2.1.25.2.1.7":  "compact_disc",
+		".1.3.6.1.2.1.25.2.1.8":  "ram_disk",
+		".1.3.6.1.2.1.25.2.1.9":  "flash_memory",
+		".1.3.6.1.2.1.25.2.1.10": "network_disk",
+	}
+
+	// hrFSTypes from HOST-RESOURCES-TYPES. Net-SNMP reports the ext2, ext3
+	// and ext4 filesystems as hrFSLinuxExt2, and btrfs as hrFSOther.
+	fsTypes = map[string]string{
+		".1.3.6.1.2.1.25.3.9.1":  "other",
+		".1.3.6.1.2.1.25.3.9.2":  "unknown",
+		".1.3.6.1.2.1.25.3.9.5":  "fat",
+		".1.3.6.1.2.1.25.3.9.9":  "ntfs",
+		".1.3.6.1.2.1.25.3.9.12": "iso9660",
+		".1.3.6.1.2.1.25.3.9.14": "nfs",
+		".1.3.6.1.2.1.25.3.9.22": "fat32",
+		".1.3.6.1.2.1.25.3.9.23": "ext",
+	}
+)
+
+// StorageMetrics are the storage areas of the Diskstation, by index
+type StorageMetrics struct {
+	Areas map[string]*StorageArea
+}
+
+// StorageArea holds the sizes of a storage area, in bytes. They are nil when
+// the Diskstation doesn't have them.
+type StorageArea struct {
+	Description string
+	// Type is the name of its hrStorageType, e.g. fixed_disk
+	Type string
+	// FSType is the name of the hrFSType of its filesystem, e.g. ext, or
+	// none if it's not a filesystem
+	FSType string
+	Size   *float64
+	Used   *float64
+}
+
+// StoragePlugin retrieves the size and usage of the storage areas (memory,
+// filesystems) from HOST-RESOURCES-MIB, in bytes.
+type StoragePlugin struct{}
+
+func (p StoragePlugin) Fetch(ctx context.Context, snmp SNMPGetter) (*StorageMetrics, error) {
+	log.Debugf("[Storage Plugin] Walk SNMP storage")
+	columns := map[string]map[string]gosnmp.SnmpPDU{}
+	for _, oid := range []string{oidStorageType, oidStorageDescr, oidStorageAllocationUnits, oidFSType, oidFSStorageIndex} {
+		rows, err := walkTable(ctx, snmp, oid)
+		if err != nil {
+			return nil, fmt.Errorf("[Storage Plugin] SNMP Error: %v", err)
+		}
+		columns[oid] = rows
+	}
+
+	// The filesystems are indexed by their own index
+	fsTypeByStorage := map[string]string{}
+	for index, variable := range columns[oidFSStorageIndex] {
+		if storage, ok := numericValue(variable); ok {
+			fsTypeByStorage[fmt.Sprintf("%d", int(storage))] = oidName(columns[oidFSType][index], fsTypes)
+		}
+	}
+
+	metrics := &StorageMetrics{Areas: map[string]*StorageArea{}}
+	for name, oid := range storageOIDs {
+		rows, err := walkTable(ctx, snmp, oid)
+		if err != nil {
+			return nil, fmt.Errorf("[Storage Plugin] SNMP Error: %v", err)
+		}
+		for index, variable := range rows {
+			value, ok := numericValue(variable)
+			if !ok {
+				continue
+			}
+			units, ok := numericValue(columns[oidStorageAllocationUnits][index])
+			if !ok {
+				continue
+			}
+			// Net-SNMP wraps the sizes above 2^31 allocation units
+			if value < 0 {
+				value += 1 << 32
+			}
+			area := metrics.Areas[index]
+			if area == nil {
+				fsType, ok := fsTypeByStorage[index]
+				if !ok {
+					fsType = "none"
+				}
+				area = &StorageArea{
+					Description: stringValue(columns[oidStorageDescr][index]),
+					Type:        oidName(columns[oidStorageType][index], storageTypes),
+					FSType:      fsType,
+				}
+				metrics.Areas[index] = area
+			}
+			bytes := value * units
+			switch name {
+			case "size":
+				area.Size = &bytes
+			case "used":
+				area.Used = &bytes
+			}
+		}
+	}
+	return metrics, nil
+}
+
+// oidName returns the name of the OID value of the variable, "unknown" if
+// it's not in names.
+func oidName(variable gosnmp.SnmpPDU, names map[string]string) string {
+	if oid, ok := variable.Value.(string); ok && names[oid] != "" {
+		return names[oid]
+	}
+	return "unknown"
+}
@@ -15,46 +15,265 @@
 package plugins
 
 import (
+	"context"
 	"fmt"
+	"math"
+	"time"
 
 	"github.com/prometheus/common/log"
 	"github.com/soniah/gosnmp"
 )
 
 var (
-	oidSystem = ".1.3.6.1.4.1.6574.1"
+	// synoSystem from SYNOLOGY-SYSTEM-MIB
+	systemBase = ".1.3.6.1.4.1.6574.1"
+	systemOIDs = map[string]string{
+		"status":           ".1.3.6.1.4.1.6574.1.1.0",   // systemStatus
+		"temperature":      ".1.3.6.1.4.1.6574.1.2.0",   // temperature
+		"powerStatus":      ".1.3.6.1.4.1.6574.1.3.0",   // powerStatus
+		"systemFanStatus":  ".1.3.6.1.4.1.6574.1.4.1.0", // systemFanStatus
+		"cpuFanStatus":     ".1.3.6.1.4.1.6574.1.4.2.0", // cpuFanStatus
+		"upgradeAvailable": ".1.3.6.1.4.1.6574.1.5.4.0", // upgradeAvailable
+	}
+
+	// systemFanStatus from SYNOLOGY-SYSTEM-MIB. Models with several system
+	// fans have a row per fan under it, instead of the .0 instance.
+	oidSystemFanStatus = ".1.3.6.1.4.1.6574.1.4.1"
+
+	// sysUpTimeInstance from SNMPv2-MIB
+	oidSysUpTime = ".1.3.6.1.2.1.1.3.0"
+
+	// hrSystemDate from HOST-RESOURCES-MIB
+	oidSystemDate = ".1.3.6.1.2.1.25.1.2.0"
+
+	// entPhySensorTable from ENTITY-SENSOR-MIB, and entPhysicalName from
+	// ENTITY-MIB naming its sensors. The SYNOLOGY-SYSTEM-MIB has no fan
+	// speed, but some models list their fans there.
+	oidSensorType      = ".1.3.6.1.2.1.99.1.1.1.1"   // entPhySensorType
+	oidSensorScale     = ".1.3.6.1.2.1.99.1.1.1.2"   // entPhySensorScale
+	oidSensorPrecision = ".1.3.6.1.2.1.99.1.1.1.3"   // entPhySensorPrecision
+	oidSensorValue     = ".1.3.6.1.2.1.99.1.1.1.4"   // entPhySensorValue
+	oidPhysicalName    = ".1.3.6.1.2.1.47.1.1.1.1.7" // entPhysicalName
+)
+
+// entPhySensorType of the fan speed sensors, and entPhySensorScale of the
+// values without multiplier
+const (
+	sensorTypeRPM    = 10
+	sensorScaleUnits = 9
 )
 
-type SystemPlugin struct{}
-
-func (p SystemPlugin) Fetch(snmp *gosnmp.GoSNMP) (map[string]float64, error) {
-	oids := []string{
-		fmt.Sprintf("%s.1", oidSystem),   // systemStatus
-		fmt.Sprintf("%s.2", oidSystem),   // temperature
-		fmt.Sprintf("%s.3", oidSystem),   // powerStatus
-		fmt.Sprintf("%s.4.1", oidSystem), // systemFanStatus
-		fmt.Sprintf("%s.4.2", oidSystem), // cpuFanStatus
-		// fmt.Sprintf("%s.5.1", oidSystem), // modelName
-		// fmt.Sprintf("%s.5.1", oidSystem), // serialNumber
-		// fmt.Sprintf("%s.5.3", oidSystem), // version
-		fmt.Sprintf("%s.5.4", oidSystem), // upgradeAvailable
-	}
-	log.Infof("[System Plugin] Get SNMP data")
-	result, err := snmp.Get(oids)
+// StatusNormal is the value of the status enums of SYNOLOGY-SYSTEM-MIB
+// (systemStatus, powerStatus, systemFanStatus, cpuFanStatus) when the
+// component works. They are 2 when it failed.
+const StatusNormal = 1
+
+// upgradeAvailable values of SYNOLOGY-SYSTEM-MIB: the other ones
+// (connecting, disconnected, others) mean the Diskstation doesn't know.
+const (
+	UpgradeAvailable   = 1
+	UpgradeUnavailable = 2
+)
+
+// SystemMetrics are the status of the Diskstation. The values are nil when
+// the Diskstation doesn't have them.
+type SystemMetrics struct {
+	Status           *float64
+	Temperature      *float64
+	PowerStatus      *float64
+	SystemFanStatus  *float64
+	CPUFanStatus     *float64
+	UpgradeAvailable *float64
+	// Uptime is in seconds
+	Uptime *float64
+	// ClockSkew is how many seconds the clock of the Diskstation is ahead
+	// of the local one, when it was fetched
+	ClockSkew *float64
+
+	// Fans are the status of each system fan, by index. The models with a
+	// single system fan have only the fan 1, of SystemFanStatus.
+	Fans map[string]float64
+
+	// FanSpeeds are the speed of the fans in RPM, by name, on the models
+	// which report it. They're only fetched with FanSpeed.
+	FanSpeeds map[string]float64
+}
+
+// SystemPlugin retrieves the status of the Diskstation. With FanSpeed, the
+// speed of the fans is walked too, so the system metrics are no longer
+// retrieved in bulk with the other ones.
+type SystemPlugin struct {
+	FanSpeed bool
+	Base     string
+}
+
+func (p SystemPlugin) Fetch(ctx context.Context, snmp SNMPGetter) (*SystemMetrics, error) {
+	log.Debugf("[System Plugin] Get SNMP data")
+	result, err := get(ctx, snmp, p.OIDs())
+	if status, ok := err.(*StatusError); ok {
+		// Older DSM versions lack some OIDs, e.g. upgradeAvailable, and
+		// fail the whole request with SNMPv1
+		log.Debugf("[System Plugin] SNMP error %d, getting the OIDs one by one", status.Status)
+		result, err = getEach(ctx, snmp, p.OIDs())
+	}
 	if err != nil {
 		return nil, fmt.Errorf("[System Plugin] SNMP Error: %v", err)
 	}
-	log.Debugf("SNMP System result: %s", result)
+	log.Debugf("SNMP System result: %v", result)
 	printSNMPResult(result)
-	return map[string]float64{
-		"system-status":          float64(gosnmp.ToBigInt(result.Variables[0].Value).Int64()),
-		"system-temperature":     float64(gosnmp.ToBigInt(result.Variables[1].Value).Int64()),
-		"system-powerStatus":     float64(gosnmp.ToBigInt(result.Variables[2].Value).Int64()),
-		"system-systemFanStatus": float64(gosnmp.ToBigInt(result.Variables[3].Value).Int64()),
-		"system-cpuFanStatus":    float64(gosnmp.ToBigInt(result.Variables[4].Value).Int64()),
-		// "system-modelName":        float64(result.Variables[5].Value.(string)),
-		// "system-serialNumber":     float64(result.Variables[6].Value.(string)),
-		// "system-version":          float64(result.Variables[7].Value.(string)),
-		"system-upgradeAvailable": float64(gosnmp.ToBigInt(result.Variables[5].Value).Int64()),
-	}, nil
+	metrics := p.parse(variablesByOID(result))
+	if metrics.SystemFanStatus == nil {
+		fans, err := walkTable(ctx, snmp, p.fanStatusOID())
+		if err != nil {
+			// Not fatal: the other metrics are still available
+			log.Warnf("[System Plugin] Can't retrieve the fans status: %v", err)
+		}
+		for fan, variable := range fans {
+			if value, ok := numericValue(variable); ok {
+				metrics.Fans[fan] = value
+			}
+		}
+	}
+	if p.FanSpeed {
+		speeds, err := getFanSpeeds(ctx, snmp)
+		if err != nil {
+			log.Warnf("[System Plugin] Can't retrieve the fans speed: %v", err)
+		}
+		metrics.FanSpeeds = speeds
+	}
+	return metrics, nil
+}
+
+// getFanSpeeds walks the RPM sensors of ENTITY-SENSOR-MIB. It returns no
+// speed when the Diskstation doesn't have them.
+func getFanSpeeds(ctx context.Context, snmp SNMPGetter) (map[string]float64, error) {
+	log.Debugf("[System Plugin] Walk SNMP sensors")
+	types, err := walkTable(ctx, snmp, oidSensorType)
+	if err != nil {
+		return nil, err
+	}
+	var fans []string
+	for index, variable := range types {
+		if value, ok := numericValue(variable); ok && value == sensorTypeRPM {
+			fans = append(fans, index)
+		}
+	}
+	speeds := map[string]float64{}
+	if len(fans) == 0 {
+		return speeds, nil
+	}
+	columns := map[string]map[string]gosnmp.SnmpPDU{}
+	for _, oid := range []string{oidSensorScale, oidSensorPrecision, oidSensorValue, oidPhysicalName} {
+		if columns[oid], err = walkTable(ctx, snmp, oid); err != nil {
+			return nil, err
+		}
+	}
+	for _, index := range fans {
+		value, ok := numericValue(columns[oidSensorValue][index])
+		if !ok {
+			continue
+		}
+		scale, ok := numericValue(columns[oidSensorScale][index])
+		if !ok {
+			scale = sensorScaleUnits
+		}
+		precision, _ := numericValue(columns[oidSensorPrecision][index])
+		name := stringValue(columns[oidPhysicalName][index])
+		if name == "" {
+			name = index
+		}
+		speeds[name] = sensorValue(value, scale, precision)
+	}
+	return speeds, nil
+}
+
+// sensorValue returns the value of a sensor from its entPhySensorValue,
+// entPhySensorScale (yocto(1) to yotta(17), units(9) for none) and
+// entPhySensorPrecision (number of decimal places).
+func sensorValue(value float64, scale float64, precision float64) float64 {
+	return value * math.Pow10(int(3*(scale-sensorScaleUnits)-precision))
+}
+
+// OIDs returns the OIDs of the system metrics
+func (p SystemPlugin) OIDs() []string {
+	return append(oidsOf(p.oids()), oidSysUpTime, oidSystemDate)
+}
+
+// Parse returns the system metrics from the values of their OIDs, or nil on
+// the models with several system fans, whose status must be walked, and with
+// FanSpeed.
+func (p SystemPlugin) Parse(variables map[string]gosnmp.SnmpPDU) *SystemMetrics {
+	metrics := p.parse(variables)
+	if metrics.SystemFanStatus == nil || p.FanSpeed {
+		return nil
+	}
+	return metrics
+}
+
+func (p SystemPlugin) parse(variables map[string]gosnmp.SnmpPDU) *SystemMetrics {
+	oids := p.oids()
+	metrics := &SystemMetrics{
+		Status:           numeric(variables[oids["status"]]),
+		Temperature:      numeric(variables[oids["temperature"]]),
+		PowerStatus:      numeric(variables[oids["powerStatus"]]),
+		SystemFanStatus:  numeric(variables[oids["systemFanStatus"]]),
+		CPUFanStatus:     numeric(variables[oids["cpuFanStatus"]]),
+		UpgradeAvailable: numeric(variables[oids["upgradeAvailable"]]),
+		Fans:             map[string]float64{},
+	}
+	if exists(variables[oidSysUpTime]) {
+		uptime := timeTicksToSeconds(variables[oidSysUpTime].Value)
+		metrics.Uptime = &uptime
+	}
+	if date, ok := dateAndTime(variables[oidSystemDate]); ok {
+		skew := date.Sub(time.Now()).Seconds()
+		metrics.ClockSkew = &skew
+	}
+	if metrics.SystemFanStatus != nil {
+		metrics.Fans["1"] = *metrics.SystemFanStatus
+	}
+	return metrics
+}
+
+// dateAndTime decodes a DateAndTime of SNMPv2-TC: the year on 2 bytes, the
+// month, day, hour, minutes, seconds and deci-seconds, then the direction
+// ('+' or '-'), hours and minutes from UTC. It returns false if it's invalid
+// or has no time zone, as the time can't be compared to the local one.
+func dateAndTime(variable gosnmp.SnmpPDU) (time.Time, bool) {
+	value, ok := variable.Value.([]byte)
+	if !ok || len(value) != 11 {
+		return time.Time{}, false
+	}
+	month, day, hour, min, sec, deci := value[2], value[3], value[4], value[5], value[6], value[7]
+	direction, tzHours, tzMinutes := value[8], value[9], value[10]
+	if month < 1 || month > 12 || day < 1 || day > 31 || hour > 23 || min > 59 || sec > 60 || deci > 9 ||
+		(direction != '+' && direction != '-') || tzHours > 14 || tzMinutes > 59 {
+		return time.Time{}, false
+	}
+	offset := int(tzHours)*3600 + int(tzMinutes)*60
+	if direction == '-' {
+		offset = -offset
+	}
+	year := int(value[0])<<8 | int(value[1])
+	return time.Date(year, time.Month(month), int(day), int(hour), int(min), int(sec), int(deci)*1e8,
+		time.FixedZone("", offset)), true
+}
+
+func (p SystemPlugin) fanStatusOID() string {
+	return rebase(oidSystemFanStatus, systemBase, p.Base)
+}
+
+func (p SystemPlugin) oids() map[string]string {
+	return rebaseAll(systemOIDs, systemBase, p.Base)
+}
+
+// DefaultBase implements Rebased
+func (p SystemPlugin) DefaultBase() string {
+	return systemBase
+}
+
+// WithBase implements Rebased
+func (p SystemPlugin) WithBase(base string) Plugin {
+	p.Base = base
+	return p
 }
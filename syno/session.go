@@ -0,0 +1,147 @@
+// Copyright (C) 2016 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syno
+
+import (
+	"context"
+
+	"github.com/soniah/gosnmp"
+
+	"github.com/nlamirault/syno_exporter/syno/plugins"
+)
+
+// Session is a SNMP session of the client to the Diskstation. The plugins
+// fetch their metrics with it.
+type Session interface {
+	plugins.SNMPGetter
+
+	// Connect opens the connection, unless it's already opened
+	Connect() error
+
+	// Close releases the connection, if it's opened
+	Close() error
+
+	GetBulk(oids []string, nonRepeaters uint8, maxRepetitions uint8) (*gosnmp.SnmpPacket, error)
+	Set(pdus []gosnmp.SnmpPDU) (*gosnmp.SnmpPacket, error)
+}
+
+// NewSession returns the Session sending the requests with a gosnmp session
+func NewSession(snmp *gosnmp.GoSNMP) Session {
+	return gosnmpSession{SNMPGetter: plugins.NewSession(snmp), snmp: snmp}
+}
+
+type gosnmpSession struct {
+	plugins.SNMPGetter
+	snmp *gosnmp.GoSNMP
+}
+
+func (s gosnmpSession) Connect() error {
+	if s.snmp.Conn != nil {
+		return nil
+	}
+	return s.snmp.Connect()
+}
+
+func (s gosnmpSession) Close() error {
+	if s.snmp.Conn == nil {
+		return nil
+	}
+	err := s.snmp.Conn.Close()
+	s.snmp.Conn = nil
+	return err
+}
+
+func (s gosnmpSession) GetBulk(oids []string, nonRepeaters uint8, maxRepetitions uint8) (*gosnmp.SnmpPacket, error) {
+	return s.snmp.GetBulk(oids, nonRepeaters, maxRepetitions)
+}
+
+func (s gosnmpSession) Set(pdus []gosnmp.SnmpPDU) (*gosnmp.SnmpPacket, error) {
+	return s.snmp.Set(pdus)
+}
+
+// session is a SNMP session of the pool of the client, with its own GoSNMP:
+// a GoSNMP has one socket and one receive buffer, so it's used by one
+// collection at a time.
+type session struct {
+	Session
+	snmp *gosnmp.GoSNMP
+
+	// target is the address the connection is opened to
+	target string
+}
+
+// cloneSNMP returns a GoSNMP, not connected, with the settings of snmp
+func cloneSNMP(snmp *gosnmp.GoSNMP) *gosnmp.GoSNMP {
+	clone := &gosnmp.GoSNMP{
+		Target:               snmp.Target,
+		Port:                 snmp.Port,
+		Transport:            snmp.Transport,
+		LocalAddr:            snmp.LocalAddr,
+		Community:            snmp.Community,
+		Version:              snmp.Version,
+		Timeout:              snmp.Timeout,
+		Retries:              snmp.Retries,
+		Logger:               snmp.Logger,
+		MaxOids:              snmp.MaxOids,
+		MaxRepetitions:       snmp.MaxRepetitions,
+		NonRepeaters:         snmp.NonRepeaters,
+		OnWalkAnomaly:        snmp.OnWalkAnomaly,
+		OnDecodeError:        snmp.OnDecodeError,
+		OnRetry:              snmp.OnRetry,
+		OnReport:             snmp.OnReport,
+		OnSecurityParameters: snmp.OnSecurityParameters,
+		MsgFlags:             snmp.MsgFlags,
+		SecurityModel:        snmp.SecurityModel,
+		ContextEngineID:      snmp.ContextEngineID,
+		ContextName:          snmp.ContextName,
+	}
+	if snmp.SecurityParameters != nil {
+		clone.SecurityParameters = snmp.SecurityParameters.Copy()
+	}
+	return clone
+}
+
+// pool returns the idle sessions of the client. The pool has Concurrency
+// sessions, created with the settings of SNMP on first use.
+func (c *Client) pool() chan *session {
+	c.openPool.Do(func() {
+		size := c.Concurrency
+		if size < 1 {
+			size = 1
+		}
+		c.sessions = make(chan *session, size)
+		for i := 0; i < size; i++ {
+			snmp := cloneSNMP(c.SNMP)
+			c.sessions <- &session{Session: c.NewSession(snmp), snmp: snmp}
+		}
+	})
+	return c.sessions
+}
+
+// acquire takes an idle session of the pool, or waits for one until the
+// context is done.
+func (c *Client) acquire(ctx context.Context) (*session, error) {
+	select {
+	case s := <-c.pool():
+		return s, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// release gives back a session to the pool
+func (c *Client) release(s *session) {
+	c.pool() <- s
+}
@@ -0,0 +1,72 @@
+// Copyright (C) 2016 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syno
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/prometheus/common/log"
+	"github.com/soniah/gosnmp"
+)
+
+// setRequests identifies the requests sent by Set in the SNMP requests
+// counters.
+const setRequests = "set"
+
+// SetError is returned by Set when the Diskstation rejected the value
+type SetError struct {
+	OID    string
+	Status gosnmp.SNMPError
+}
+
+func (e *SetError) Error() string {
+	return fmt.Sprintf("Can't set %s: SNMP error status %d", e.OID, e.Status)
+}
+
+// Set sends a SetRequest writing the value of the OID. The value is an int
+// (Integer) or a string (OctetString). If the Diskstation rejects it (e.g. the
+// OID isn't writable or the community is read-only), a *SetError gives the
+// error status of the response.
+func (c *Client) Set(oid string, value interface{}) error {
+	log.Debugf("[Client] Set %s: %v", oid, value)
+	pdu := gosnmp.SnmpPDU{Name: oid, Value: value}
+	switch value.(type) {
+	case int:
+		pdu.Type = gosnmp.Integer
+	case string:
+		pdu.Type = gosnmp.OctetString
+	default:
+		return fmt.Errorf("Can't set %s: unsupported value type %T", oid, value)
+	}
+
+	s, err := c.acquire(context.Background())
+	if err != nil {
+		return err
+	}
+	defer c.release(s)
+	if err := c.connect(s); err != nil {
+		return err
+	}
+	result, err := s.Set([]gosnmp.SnmpPDU{pdu})
+	c.recordRequest(setRequests, "set", err)
+	if err != nil {
+		return fmt.Errorf("Can't set %s: %s", oid, err)
+	}
+	if result.Error != gosnmp.NoError {
+		return &SetError{OID: oid, Status: result.Error}
+	}
+	return nil
+}
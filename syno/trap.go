@@ -0,0 +1,93 @@
+// Copyright (C) 2016 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syno
+
+import (
+	"net"
+	"sync"
+
+	"github.com/prometheus/common/log"
+	"github.com/soniah/gosnmp"
+)
+
+// snmpTrapOID from SNMPv2-MIB: the second variable of the SNMPv2 traps and
+// informs, identifying them
+const oidSnmpTrapOID = ".1.3.6.1.6.3.1.1.4.1.0"
+
+// TrapKey identifies the traps counted by a TrapReceiver
+type TrapKey struct {
+	// Source is the IP of the Diskstation which sent the trap
+	Source string
+	// OID is the snmpTrapOID of the trap, e.g. the disk failure one
+	OID string
+}
+
+// TrapReceiver counts the SNMPv2c traps and informs sent by the
+// Diskstations.
+type TrapReceiver struct {
+	listener *gosnmp.TrapListener
+
+	mu    sync.Mutex
+	traps map[TrapKey]uint64
+}
+
+// NewTrapReceiver defines a new receiver. It doesn't listen until Listen
+// is called.
+func NewTrapReceiver() *TrapReceiver {
+	r := &TrapReceiver{traps: map[TrapKey]uint64{}}
+	r.listener = &gosnmp.TrapListener{
+		OnNewTrap: r.onTrap,
+		Params:    &gosnmp.GoSNMP{Version: gosnmp.Version2c},
+	}
+	return r
+}
+
+// Listen receives the traps on the UDP address addr until Close is called
+func (r *TrapReceiver) Listen(addr string) error {
+	return r.listener.Listen(addr)
+}
+
+// Close stops the receiver
+func (r *TrapReceiver) Close() {
+	r.listener.Close()
+}
+
+// Traps returns the number of traps received, by source and OID
+func (r *TrapReceiver) Traps() map[TrapKey]uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	traps := make(map[TrapKey]uint64, len(r.traps))
+	for key, count := range r.traps {
+		traps[key] = count
+	}
+	return traps
+}
+
+func (r *TrapReceiver) onTrap(packet *gosnmp.SnmpPacket, addr *net.UDPAddr) {
+	key := TrapKey{Source: addr.IP.String()}
+	for _, variable := range packet.Variables {
+		if oid, ok := variable.Value.(string); ok && variable.Name == oidSnmpTrapOID {
+			key.OID = oid
+		}
+	}
+	if key.OID == "" {
+		log.Warnf("Trap without snmpTrapOID from %s: %v", key.Source, packet.Variables)
+		return
+	}
+	log.Debugf("Trap %s from %s: %v", key.OID, key.Source, packet.Variables)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.traps[key]++
+}
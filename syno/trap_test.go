@@ -0,0 +1,96 @@
+// Copyright (C) 2016 Nicolas Lamirault <nicolas.lamirault@gmail.com>
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syno
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/soniah/gosnmp"
+)
+
+func TestTrapReceiver(t *testing.T) {
+	// Reserve a free port for the receiver
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("Can't listen: %s", err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+
+	receiver := NewTrapReceiver()
+	done := make(chan error)
+	go func() { done <- receiver.Listen(addr) }()
+	defer func() {
+		receiver.Close()
+		if err := <-done; err != nil {
+			t.Fatalf("Can't receive traps: %s", err)
+		}
+	}()
+
+	sender, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Can't connect: %s", err)
+	}
+	defer sender.Close()
+
+	// SNMPv2c InformRequest of .1.3.6.1.4.1.6574.2.0.1 (sysUpTime.0 and
+	// snmpTrapOID.0 varbinds)
+	inform := ber(0x30,
+		ber(gosnmp.Integer, []byte{1}),
+		ber(gosnmp.OctetString, []byte("public")),
+		ber(byte(gosnmp.InformRequest),
+			ber(gosnmp.Integer, []byte{42}),
+			ber(gosnmp.Integer, []byte{0}),
+			ber(gosnmp.Integer, []byte{0}),
+			ber(0x30,
+				ber(0x30,
+					ber(gosnmp.ObjectIdentifier, []byte{0x2b, 6, 1, 2, 1, 1, 3, 0}),
+					ber(gosnmp.TimeTicks, []byte{0x01, 0x00})),
+				ber(0x30,
+					ber(gosnmp.ObjectIdentifier, []byte{0x2b, 6, 1, 6, 3, 1, 1, 4, 1, 0}),
+					ber(gosnmp.ObjectIdentifier, []byte{0x2b, 6, 1, 4, 1, 0xb3, 0x2e, 2, 0, 1})))))
+
+	// The receiver may not listen yet: send the inform until it's
+	// acknowledged.
+	buf := make([]byte, 4096)
+	for i := 0; ; i++ {
+		if i == 50 {
+			t.Fatal("InformRequest not acknowledged")
+		}
+		sender.Write(inform)
+		sender.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, err := sender.Read(buf)
+		if err != nil {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		_, message, _ := readTLV(buf[:n])
+		_, _, rest := readTLV(message)
+		_, _, rest = readTLV(rest)
+		tag, pdu, _ := readTLV(rest)
+		_, requestID, _ := readTLV(pdu)
+		if tag != byte(gosnmp.GetResponse) || len(requestID) != 1 || requestID[0] != 42 {
+			t.Fatalf("Invalid response: %x", buf[:n])
+		}
+		break
+	}
+
+	key := TrapKey{Source: "127.0.0.1", OID: ".1.3.6.1.4.1.6574.2.0.1"}
+	if traps := receiver.Traps(); traps[key] == 0 || len(traps) != 1 {
+		t.Fatalf("Invalid traps: %v", traps)
+	}
+}
@@ -15,389 +15,1859 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
 	"github.com/prometheus/common/log"
 	prom_version "github.com/prometheus/common/version"
+	"github.com/soniah/gosnmp"
 
+	"github.com/nlamirault/syno_exporter/config"
 	"github.com/nlamirault/syno_exporter/syno"
+	"github.com/nlamirault/syno_exporter/syno/plugins"
 	"github.com/nlamirault/syno_exporter/version"
 )
 
 const (
-	namespace = "syno"
+	// defaultNamespace prefixes the names of the metrics, unless
+	// Options.Namespace is set.
+	defaultNamespace = "syno"
+
+	// shutdownTimeout is the delay given to the pending scrapes to end
+	// when the exporter is stopped.
+	shutdownTimeout = 10 * time.Second
 )
 
-var (
-	systemStatus = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "system_status"),
-		"Diskstation system status.",
-		nil, nil,
-	)
-	systemTemperature = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "system_temperature"),
-		"DiskStation temperature.",
-		nil, nil,
-	)
-	systemPowerStatus = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "system_power_status"),
-		"Returns error if power supplies fail.",
-		nil, nil,
-	)
-	systemFanStatus = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "system_fan_status"),
-		"Returns error if system fan fails.",
-		nil, nil,
-	)
-	systemCPUFanStatus = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "system_cpu_status"),
-		"Returns error if CPU fan fails.",
-		nil, nil,
-	)
-	systemUpgradeAvailable = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "system_upgrade_available"),
-		"Checks whether a new version or update of DSM is available",
-		nil, nil,
-	)
+// namespaceRE matches the valid prefixes of the metric names
+var namespaceRE = regexp.MustCompile("^[a-zA-Z_:][a-zA-Z0-9_:]*$")
 
-	memTotalSwap = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "mem_total_swap"),
-		"The total amount of swap space configured for this host.",
-		nil, nil,
-	)
-	memAvailSwap = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "mem_avail_swap"),
-		"The amount of swap space currently unused or available.",
-		nil, nil,
-	)
-	memTotalReal = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "mem_total_real"),
-		"The total amount of real/physical memory installed on this host.",
-		nil, nil,
-	)
-	memAvailReal = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "mem_avail_real"),
-		"The amount of real/physical memory currently unused or available.",
-		nil, nil,
-	)
-	memTotalFree = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "mem_total_free"),
-		"The total amount of memory free or available for use on this host.",
-		nil, nil,
-	)
-	memShared = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "mem_shared"),
-		"The total amount of real or virtual memory currently allocated for use as shared memory.",
-		nil, nil,
-	)
-	memBuffer = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "mem_buffer"),
-		"The total amount of real or virtual memory currently allocated for use as memory buffers.",
-		nil, nil,
-	)
-	memCached = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "mem_cached"),
-		"The total amount of real or virtual memory currently allocated for use as cached memory.",
-		nil, nil,
-	)
+// descriptors holds the descriptions of the metrics exported for one
+// Diskstation.
+type descriptors struct {
+	up              *prometheus.Desc
+	scrapeDuration  *prometheus.Desc
+	snmpReconnects  *prometheus.Desc
+	walkAnomalies   *prometheus.Desc
+	decodeErrors    *prometheus.Desc
+	snmpRetries     *prometheus.Desc
+	metricsStale    *prometheus.Desc
+	collectDuration *prometheus.Desc
+	snmpRequests    *prometheus.Desc
+	snmpErrors      *prometheus.Desc
+	scrapeErrors    *prometheus.Desc
+	lastScrapeError *prometheus.Desc
 
-	loadShort = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "load_short"),
-		"1 minute Load",
-		nil, nil,
-	)
-	loadMid = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "load_mid"),
-		"5 minute Load",
-		nil, nil,
-	)
-	loadLong = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "load_long"),
-		"15 minute Load",
-		nil, nil,
-	)
+	systemStatus                *prometheus.Desc
+	systemTemperatureCelsius    *prometheus.Desc
+	systemTemperatureFahrenheit *prometheus.Desc
+	systemPowerStatus           *prometheus.Desc
+	systemFanStatus             *prometheus.Desc
+	systemCPUFanStatus          *prometheus.Desc
+	systemPowerOK               *prometheus.Desc
+	systemFanOK                 *prometheus.Desc
+	systemCPUFanOK              *prometheus.Desc
+	systemFanRPM                *prometheus.Desc
+	systemUpgradeAvailable      *prometheus.Desc
+	dsmUpdateAvailable          *prometheus.Desc
+	systemUptime                *prometheus.Desc
+	clockSkew                   *prometheus.Desc
 
-	cpuUser = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "cpu_user"),
-		"The number of 'ticks' spent processing user-level code.",
-		nil, nil,
-	)
-	cpuNice = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "cpu_nice"),
-		"The number of 'ticks' spent processing reduced-priority code.",
-		nil, nil,
-	)
-	cpuSystem = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "cpu_system"),
-		"The number of 'ticks' spent processing system-level code.",
-		nil, nil,
-	)
-	cpuIdle = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "cpu_idle"),
-		"The number of 'ticks' spent processing idle.",
-		nil, nil,
-	)
-	cpuWait = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "cpu_wait"),
-		"The number of 'ticks' spent waiting for IO",
-		nil, nil,
-	)
-	cpuKernel = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "cpu_kernel"),
-		"The number of 'ticks' spent processing kernel-level code.",
-		nil, nil,
-	)
-	cpuInterrupt = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "cpu_interrupt"),
-		"The number of 'ticks' spent processing hardware interrupts.",
-		nil, nil,
-	)
+	memTotalSwap *prometheus.Desc
+	memAvailSwap *prometheus.Desc
+	memTotalReal *prometheus.Desc
+	memAvailReal *prometheus.Desc
+	memTotalFree *prometheus.Desc
+	memShared    *prometheus.Desc
+	memBuffer    *prometheus.Desc
+	memCached    *prometheus.Desc
 
-	netIn = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "net_in"),
-		"The total number of octets received on the interface",
-		nil, nil,
-	)
-	netOut = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "net_out"),
-		"The total number of octets transmitted out of the interface",
-		nil, nil,
-	)
-)
+	loadAverage *prometheus.Desc
+	loadShort   *prometheus.Desc
+	loadMid     *prometheus.Desc
+	loadLong    *prometheus.Desc
+
+	cpuUser      *prometheus.Desc
+	cpuNice      *prometheus.Desc
+	cpuSystem    *prometheus.Desc
+	cpuIdle      *prometheus.Desc
+	cpuWait      *prometheus.Desc
+	cpuKernel    *prometheus.Desc
+	cpuInterrupt *prometheus.Desc
+	cpuCoreLoad  *prometheus.Desc
+	cpuUsage     *prometheus.Desc
+
+	diskTemperatureCelsius    *prometheus.Desc
+	diskTemperatureFahrenheit *prometheus.Desc
+	diskTemperatureExceeded   *prometheus.Desc
+	diskInfo                  *prometheus.Desc
+	diskBadSectors            *prometheus.Desc
+	diskCount                 *prometheus.Desc
+	diskIOReads               *prometheus.Desc
+	diskIOWrites              *prometheus.Desc
+	diskIOReadBytes           *prometheus.Desc
+	diskIOWrittenBytes        *prometheus.Desc
+	diskLoad                  *prometheus.Desc
+
+	netIn                *prometheus.Desc
+	netOut               *prometheus.Desc
+	netInterfaceBytes    *prometheus.Desc
+	netInterfaceErrors   *prometheus.Desc
+	netInterfaceDiscards *prometheus.Desc
+	netCounterWraps      *prometheus.Desc
+
+	serviceConnections *prometheus.Desc
+	smbConnections     *prometheus.Desc
+	nfsConnections     *prometheus.Desc
+	afpConnections     *prometheus.Desc
+
+	storageSize *prometheus.Desc
+	storageUsed *prometheus.Desc
+
+	volumeTotal *prometheus.Desc
+	volumeFree  *prometheus.Desc
+	volumeCount *prometheus.Desc
+
+	// custom are the descriptions of the custom metrics, by name. Their
+	// rows are labeled by index, unless their OID is a scalar.
+	custom map[string]*prometheus.Desc
+
+	// help describes the metrics above for the landing page
+	help map[*prometheus.Desc]metricHelp
+}
+
+// newDescriptors returns the descriptions of the metrics, with the given
+// constant labels, prefixed by the namespace. The custom metrics are the ones
+// of the OIDs of the custom plugin.
+func newDescriptors(namespace string, labels prometheus.Labels, custom plugins.CustomPlugin) *descriptors {
+	help := map[*prometheus.Desc]metricHelp{}
+	newDesc := func(fqName, helpText string, variableLabels []string, constLabels prometheus.Labels) *prometheus.Desc {
+		desc := prometheus.NewDesc(fqName, helpText, variableLabels, constLabels)
+		help[desc] = metricHelp{
+			Name:   fqName,
+			Labels: strings.Join(variableLabels, ", "),
+			Help:   helpText,
+		}
+		return desc
+	}
+	descs := &descriptors{
+		up: newDesc(
+			prometheus.BuildFQName(namespace, "", "up"),
+			"Whether the last collection from the Diskstation was successful.",
+			nil, labels,
+		),
+		scrapeDuration: newDesc(
+			prometheus.BuildFQName(namespace, "", "scrape_duration_seconds"),
+			"Duration of the SNMP collection from the Diskstation.",
+			nil, labels,
+		),
+		snmpReconnects: newDesc(
+			prometheus.BuildFQName(namespace, "", "snmp_reconnects_total"),
+			"Number of times the SNMP connection to the Diskstation was reopened.",
+			nil, labels,
+		),
+		walkAnomalies: newDesc(
+			prometheus.BuildFQName(namespace, "", "snmp_walk_anomalies_total"),
+			"Number of variables skipped by the SNMP walks as their OID didn't increase.",
+			nil, labels,
+		),
+		decodeErrors: newDesc(
+			prometheus.BuildFQName(namespace, "", "snmp_decode_errors_total"),
+			"Number of SNMP responses from the Diskstation which couldn't be decoded.",
+			nil, labels,
+		),
+		snmpRetries: newDesc(
+			prometheus.BuildFQName(namespace, "", "snmp_retries_total"),
+			"Number of SNMP requests sent again to the Diskstation as it didn't answer in time.",
+			nil, labels,
+		),
+
+		metricsStale: newDesc(
+			prometheus.BuildFQName(namespace, "", "metrics_stale"),
+			"Whether the metrics of the collector are the last ones successfully retrieved, as the collection failed.",
+			[]string{"collector"}, labels,
+		),
+		collectDuration: newDesc(
+			prometheus.BuildFQName(namespace, "snmp", "collect_duration_seconds"),
+			"Duration of the SNMP collection of the plugin.",
+			[]string{"plugin"}, labels,
+		),
+
+		snmpRequests: newDesc(
+			prometheus.BuildFQName(namespace, "", "snmp_requests_total"),
+			"Number of SNMP requests sent to the Diskstation.",
+			[]string{"plugin", "type"}, labels,
+		),
+		snmpErrors: newDesc(
+			prometheus.BuildFQName(namespace, "", "snmp_errors_total"),
+			"Number of SNMP requests to the Diskstation which failed.",
+			[]string{"plugin", "type"}, labels,
+		),
+		scrapeErrors: newDesc(
+			prometheus.BuildFQName(namespace, "exporter", "scrape_errors_total"),
+			"Number of collections from the Diskstation which failed, by collector.",
+			[]string{"collector"}, labels,
+		),
+		lastScrapeError: newDesc(
+			prometheus.BuildFQName(namespace, "exporter", "last_scrape_error"),
+			"Whether the last collection from the Diskstation had an error.",
+			nil, labels,
+		),
+
+		systemStatus: newDesc(
+			prometheus.BuildFQName(namespace, "", "system_status"),
+			"Diskstation system status.",
+			nil, labels,
+		),
+		systemTemperatureCelsius: newDesc(
+			prometheus.BuildFQName(namespace, "", "system_temperature_celsius"),
+			"DiskStation temperature in degrees Celsius.",
+			nil, labels,
+		),
+		systemTemperatureFahrenheit: newDesc(
+			prometheus.BuildFQName(namespace, "", "system_temperature_fahrenheit"),
+			"DiskStation temperature in degrees Fahrenheit.",
+			nil, labels,
+		),
+		systemPowerStatus: newDesc(
+			prometheus.BuildFQName(namespace, "", "system_power_status"),
+			"Power supplies status: 1 for Normal, 2 for Failed.",
+			nil, labels,
+		),
+		systemFanStatus: newDesc(
+			prometheus.BuildFQName(namespace, "", "system_fan_status"),
+			"System fan status: 1 for Normal, 2 for Failed.",
+			nil, labels,
+		),
+		systemCPUFanStatus: newDesc(
+			prometheus.BuildFQName(namespace, "", "system_cpu_status"),
+			"CPU fan status: 1 for Normal, 2 for Failed.",
+			nil, labels,
+		),
+		systemPowerOK: newDesc(
+			prometheus.BuildFQName(namespace, "", "system_power_ok"),
+			"Whether the power supplies are normal.",
+			nil, labels,
+		),
+		systemFanOK: newDesc(
+			prometheus.BuildFQName(namespace, "", "system_fan_ok"),
+			"Whether the system fan is normal.",
+			[]string{"fan"}, labels,
+		),
+		systemCPUFanOK: newDesc(
+			prometheus.BuildFQName(namespace, "", "system_cpu_fan_ok"),
+			"Whether the CPU fan is normal.",
+			nil, labels,
+		),
+		systemFanRPM: newDesc(
+			prometheus.BuildFQName(namespace, "", "system_fan_rpm"),
+			"Speed of the fan, in revolutions per minute.",
+			[]string{"fan"}, labels,
+		),
+		systemUpgradeAvailable: newDesc(
+			prometheus.BuildFQName(namespace, "", "system_upgrade_available"),
+			"Checks whether a new version or update of DSM is available",
+			nil, labels,
+		),
+		dsmUpdateAvailable: newDesc(
+			prometheus.BuildFQName(namespace, "", "dsm_update_available"),
+			"Whether a DSM update is available.",
+			nil, labels,
+		),
+		systemUptime: newDesc(
+			prometheus.BuildFQName(namespace, "", "system_uptime_seconds"),
+			"Time since the network management portion of the system was last re-initialized.",
+			nil, labels,
+		),
+		clockSkew: newDesc(
+			prometheus.BuildFQName(namespace, "", "clock_skew_seconds"),
+			"Difference between the time of the Diskstation and the one of the exporter, positive when the Diskstation is ahead.",
+			nil, labels,
+		),
+
+		memTotalSwap: newDesc(
+			prometheus.BuildFQName(namespace, "", "mem_total_swap_bytes"),
+			"The total amount of swap space configured for this host, in bytes.",
+			nil, labels,
+		),
+		memAvailSwap: newDesc(
+			prometheus.BuildFQName(namespace, "", "mem_avail_swap_bytes"),
+			"The amount of swap space currently unused or available, in bytes.",
+			nil, labels,
+		),
+		memTotalReal: newDesc(
+			prometheus.BuildFQName(namespace, "", "mem_total_real_bytes"),
+			"The total amount of real/physical memory installed on this host, in bytes.",
+			nil, labels,
+		),
+		memAvailReal: newDesc(
+			prometheus.BuildFQName(namespace, "", "mem_avail_real_bytes"),
+			"The amount of real/physical memory currently unused or available, in bytes.",
+			nil, labels,
+		),
+		memTotalFree: newDesc(
+			prometheus.BuildFQName(namespace, "", "mem_total_free_bytes"),
+			"The total amount of memory free or available for use on this host, in bytes.",
+			nil, labels,
+		),
+		memShared: newDesc(
+			prometheus.BuildFQName(namespace, "", "mem_shared_bytes"),
+			"The total amount of real or virtual memory currently allocated for use as shared memory, in bytes.",
+			nil, labels,
+		),
+		memBuffer: newDesc(
+			prometheus.BuildFQName(namespace, "", "mem_buffer_bytes"),
+			"The total amount of real or virtual memory currently allocated for use as memory buffers, in bytes.",
+			nil, labels,
+		),
+		memCached: newDesc(
+			prometheus.BuildFQName(namespace, "", "mem_cached_bytes"),
+			"The total amount of real or virtual memory currently allocated for use as cached memory, in bytes.",
+			nil, labels,
+		),
+
+		loadAverage: newDesc(
+			prometheus.BuildFQName(namespace, "", "load_average"),
+			"Load average over the period.",
+			[]string{"period"}, labels,
+		),
+		loadShort: newDesc(
+			prometheus.BuildFQName(namespace, "", "load_short"),
+			"1 minute Load",
+			nil, labels,
+		),
+		loadMid: newDesc(
+			prometheus.BuildFQName(namespace, "", "load_mid"),
+			"5 minute Load",
+			nil, labels,
+		),
+		loadLong: newDesc(
+			prometheus.BuildFQName(namespace, "", "load_long"),
+			"15 minute Load",
+			nil, labels,
+		),
+
+		cpuUser: newDesc(
+			prometheus.BuildFQName(namespace, "", "cpu_user"),
+			"The number of 'ticks' spent processing user-level code.",
+			nil, labels,
+		),
+		cpuNice: newDesc(
+			prometheus.BuildFQName(namespace, "", "cpu_nice"),
+			"The number of 'ticks' spent processing reduced-priority code.",
+			nil, labels,
+		),
+		cpuSystem: newDesc(
+			prometheus.BuildFQName(namespace, "", "cpu_system"),
+			"The number of 'ticks' spent processing system-level code.",
+			nil, labels,
+		),
+		cpuIdle: newDesc(
+			prometheus.BuildFQName(namespace, "", "cpu_idle"),
+			"The number of 'ticks' spent processing idle.",
+			nil, labels,
+		),
+		cpuWait: newDesc(
+			prometheus.BuildFQName(namespace, "", "cpu_wait"),
+			"The number of 'ticks' spent waiting for IO",
+			nil, labels,
+		),
+		cpuKernel: newDesc(
+			prometheus.BuildFQName(namespace, "", "cpu_kernel"),
+			"The number of 'ticks' spent processing kernel-level code.",
+			nil, labels,
+		),
+		cpuInterrupt: newDesc(
+			prometheus.BuildFQName(namespace, "", "cpu_interrupt"),
+			"The number of 'ticks' spent processing hardware interrupts.",
+			nil, labels,
+		),
+		cpuCoreLoad: newDesc(
+			prometheus.BuildFQName(namespace, "", "cpu_core_load"),
+			"The average percentage of time the processor core was not idle over the last minute.",
+			[]string{"core"}, labels,
+		),
+		cpuUsage: newDesc(
+			prometheus.BuildFQName(namespace, "", "cpu_usage_percent"),
+			"The percentage of time the CPU was not idle since the previous scrape.",
+			nil, labels,
+		),
+
+		diskTemperatureCelsius: newDesc(
+			prometheus.BuildFQName(namespace, "", "disk_temperature_celsius"),
+			"Disk temperature in degrees Celsius.",
+			[]string{"disk"}, labels,
+		),
+		diskTemperatureFahrenheit: newDesc(
+			prometheus.BuildFQName(namespace, "", "disk_temperature_fahrenheit"),
+			"Disk temperature in degrees Fahrenheit.",
+			[]string{"disk"}, labels,
+		),
+		diskTemperatureExceeded: newDesc(
+			prometheus.BuildFQName(namespace, "", "disk_temperature_exceeded"),
+			"Whether the disk temperature is above the warning threshold.",
+			[]string{"disk"}, labels,
+		),
+		diskInfo: newDesc(
+			prometheus.BuildFQName(namespace, "", "disk_info"),
+			"Information about the disk, with a constant '1' value.",
+			[]string{"disk", "id", "model", "enclosure"}, labels,
+		),
+		diskBadSectors: newDesc(
+			prometheus.BuildFQName(namespace, "", "disk_bad_sectors"),
+			"The number of bad sectors of the disk.",
+			[]string{"disk"}, labels,
+		),
+		diskCount: newDesc(
+			prometheus.BuildFQName(namespace, "", "disk_count"),
+			"The number of disks of the Diskstation and its expansion units.",
+			nil, labels,
+		),
+		diskIOReads: newDesc(
+			prometheus.BuildFQName(namespace, "", "disk_io_reads_total"),
+			"The number of read accesses from the disk since boot.",
+			[]string{"disk"}, labels,
+		),
+		diskIOWrites: newDesc(
+			prometheus.BuildFQName(namespace, "", "disk_io_writes_total"),
+			"The number of write accesses to the disk since boot.",
+			[]string{"disk"}, labels,
+		),
+		diskIOReadBytes: newDesc(
+			prometheus.BuildFQName(namespace, "", "disk_io_read_bytes_total"),
+			"The number of bytes read from the disk since boot.",
+			[]string{"disk"}, labels,
+		),
+		diskIOWrittenBytes: newDesc(
+			prometheus.BuildFQName(namespace, "", "disk_io_written_bytes_total"),
+			"The number of bytes written to the disk since boot.",
+			[]string{"disk"}, labels,
+		),
+		diskLoad: newDesc(
+			prometheus.BuildFQName(namespace, "", "disk_load_percent"),
+			"The load of the disk in percent.",
+			[]string{"disk"}, labels,
+		),
+
+		netIn: newDesc(
+			prometheus.BuildFQName(namespace, "", "net_in"),
+			"The total number of octets received on the interfaces, loopback excluded.",
+			nil, labels,
+		),
+		netOut: newDesc(
+			prometheus.BuildFQName(namespace, "", "net_out"),
+			"The total number of octets transmitted out of the interfaces, loopback excluded.",
+			nil, labels,
+		),
+		netInterfaceBytes: newDesc(
+			prometheus.BuildFQName(namespace, "", "net_interface_bytes_total"),
+			"The number of octets received or transmitted on the interface.",
+			[]string{"interface", "direction"}, labels,
+		),
+		netInterfaceErrors: newDesc(
+			prometheus.BuildFQName(namespace, "", "net_interface_errors_total"),
+			"The number of packets that could not be transmitted or delivered because of errors.",
+			[]string{"interface", "direction"}, labels,
+		),
+		netInterfaceDiscards: newDesc(
+			prometheus.BuildFQName(namespace, "", "net_interface_discards_total"),
+			"The number of packets discarded even though no errors had been detected.",
+			[]string{"interface", "direction"}, labels,
+		),
+		netCounterWraps: newDesc(
+			prometheus.BuildFQName(namespace, "", "net_counter_wraps_total"),
+			"Number of times a 32 bits counter of the interfaces decreased: it wrapped, or the Diskstation rebooted.",
+			nil, labels,
+		),
+
+		serviceConnections: newDesc(
+			prometheus.BuildFQName(namespace, "", "service_connections"),
+			"The number of users connected to the service.",
+			[]string{"service"}, labels,
+		),
+		smbConnections: newDesc(
+			prometheus.BuildFQName(namespace, "", "smb_connections"),
+			"The number of users connected to the SMB (CIFS) service.",
+			nil, labels,
+		),
+		nfsConnections: newDesc(
+			prometheus.BuildFQName(namespace, "", "nfs_connections"),
+			"The number of users connected to the NFS service.",
+			nil, labels,
+		),
+		afpConnections: newDesc(
+			prometheus.BuildFQName(namespace, "", "afp_connections"),
+			"The number of users connected to the AFP service.",
+			nil, labels,
+		),
+
+		storageSize: newDesc(
+			prometheus.BuildFQName(namespace, "storage", "size_bytes"),
+			"The size of the storage area in bytes.",
+			[]string{"storage", "type", "fs_type"}, labels,
+		),
+		storageUsed: newDesc(
+			prometheus.BuildFQName(namespace, "storage", "used_bytes"),
+			"The used space of the storage area in bytes.",
+			[]string{"storage", "type", "fs_type"}, labels,
+		),
+
+		volumeTotal: newDesc(
+			prometheus.BuildFQName(namespace, "volume", "total_bytes"),
+			"The size of the volume in bytes.",
+			[]string{"volume"}, labels,
+		),
+		volumeFree: newDesc(
+			prometheus.BuildFQName(namespace, "volume", "free_bytes"),
+			"The free space of the volume in bytes.",
+			[]string{"volume"}, labels,
+		),
+		volumeCount: newDesc(
+			prometheus.BuildFQName(namespace, "", "volume_count"),
+			"The number of volumes.",
+			nil, labels,
+		),
+
+		custom: map[string]*prometheus.Desc{},
+		help:   help,
+	}
+	for name, oid := range custom.OIDs {
+		var labelNames []string
+		if !custom.Scalar(name) {
+			labelNames = []string{"index"}
+		}
+		descs.custom[name] = newDesc(
+			prometheus.BuildFQName(namespace, "custom", name),
+			fmt.Sprintf("Value of the custom OID %s.", oid),
+			labelNames, labels,
+		)
+	}
+	return descs
+}
+
+// Options defines how the metrics are exported, whatever the Diskstation.
+type Options struct {
+	// Fahrenheit exports the temperatures in degrees Fahrenheit instead of
+	// degrees Celsius.
+	Fahrenheit bool
+
+	// ScrapeTimeout bounds the duration of a collection. The pending SNMP
+	// requests are aborted when it expires. Zero means no timeout.
+	ScrapeTimeout time.Duration
+
+	// FetchRetries is how many times a collector is retried when the
+	// Diskstation didn't answer. The retries are bounded by ScrapeTimeout.
+	FetchRetries int
+
+	// Concurrency is the number of collectors sending SNMP requests to a
+	// Diskstation at the same time. Zero means syno.DefaultConcurrency.
+	Concurrency int
+
+	// LegacyLoadMetrics exports syno_load_short, syno_load_mid and
+	// syno_load_long along with syno_load_average.
+	LegacyLoadMetrics bool
+
+	// DiskTemperatureWarn is the disk temperature, in the configured unit,
+	// above which syno_disk_temperature_exceeded is 1. Zero disables it.
+	DiskTemperatureWarn float64
+
+	// Namespace prefixes the names of the metrics instead of "syno"
+	Namespace string
+}
 
 // Exporter collects Syno stats from the given server and exports them using
 // the prometheus metrics package.
 type Exporter struct {
-	Client *syno.Client
+	Client  *syno.Client
+	Options Options
+
+	// Target is the configuration the client was created from, shown by
+	// /config. It's nil for the probes.
+	Target *config.Target
+
+	// ctx is the context the collections are derived from, e.g. the one
+	// of the HTTP request probing the Diskstation.
+	ctx context.Context
+
+	descs *descriptors
+
+	// mu guards the status of the last collection, shown on the landing
+	// page.
+	mu         sync.Mutex
+	lastScrape time.Time
+	lastErrors []error
+
+	// scrapeErrors counts the failed collections, by collector. Guarded
+	// by mu.
+	scrapeErrors map[string]uint64
+
+	// cpuTicks are the CPU tick counters of the previous scrape, from which
+	// the CPU usage is computed. Guarded by mu.
+	cpuTicks []float64
 }
 
 // NewExporter returns an initialized Exporter.
-func NewExporter(dsIP string, interval time.Duration) (*Exporter, error) {
-	log.Infof("Setup Syno client using diskstation: %s and interval %s\n", dsIP, interval)
-	client, err := syno.NewClient(dsIP, interval)
+func NewExporter(target *config.Target, opts Options) (*Exporter, error) {
+	client, err := syno.NewClientFromConfig(target)
 	if err != nil {
 		return nil, fmt.Errorf("Can't create the Syno client: %s", err)
 	}
+	log.Debugf("Setup Syno client using diskstation: %s and interval %s\n", client.Diskstation, client.Interval)
+
+	exporter := newExporter(client, target.Name, opts)
+	exporter.Target = target
+	return exporter, nil
+}
 
-	log.Debugln("Init exporter")
+// newExporter returns an Exporter for the given client. Its metrics are
+// labeled with the name of the Diskstation, or its address if it's empty.
+func newExporter(client *syno.Client, name string, opts Options) *Exporter {
+	if name == "" {
+		name = client.Diskstation
+	}
+	log.Debugf("Init exporter for %s", name)
+	client.FetchRetries = opts.FetchRetries
+	if opts.Concurrency > 0 {
+		client.Concurrency = opts.Concurrency
+	}
+	namespace := opts.Namespace
+	if namespace == "" {
+		namespace = defaultNamespace
+	}
+	custom, _ := client.Plugins["custom"].(plugins.CustomPlugin)
 	return &Exporter{
-		Client: client,
-	}, nil
+		Client:  client,
+		Options: opts,
+		ctx:     context.Background(),
+		descs:   newDescriptors(namespace, prometheus.Labels{"diskstation": name}, custom),
+
+		scrapeErrors: map[string]uint64{},
+	}
+}
+
+// NewExporterWithRegistry returns an initialized Exporter, registered on the
+// given registry.
+func NewExporterWithRegistry(target *config.Target, opts Options, registry prometheus.Registerer) (*Exporter, error) {
+	exporter, err := NewExporter(target, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := registry.Register(exporter); err != nil {
+		return nil, fmt.Errorf("Can't register the exporter: %s", err)
+	}
+	return exporter, nil
+}
+
+// temperatureDescs returns the system and disk temperatures descriptors for
+// the configured unit.
+func (e *Exporter) temperatureDescs() (system *prometheus.Desc, disk *prometheus.Desc) {
+	if e.Options.Fahrenheit {
+		return e.descs.systemTemperatureFahrenheit, e.descs.diskTemperatureFahrenheit
+	}
+	return e.descs.systemTemperatureCelsius, e.descs.diskTemperatureCelsius
+}
+
+// temperature converts a temperature in degrees Celsius to the configured
+// unit.
+func (e *Exporter) temperature(celsius float64) float64 {
+	if e.Options.Fahrenheit {
+		return celsius*9/5 + 32
+	}
+	return celsius
 }
 
 // Describe describes all the metrics ever exported by the Syno exporter.
 // It implements prometheus.Collector.
 func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
-	ch <- systemStatus
+	ch <- e.descs.up
+	ch <- e.descs.scrapeDuration
+	ch <- e.descs.snmpReconnects
+	ch <- e.descs.walkAnomalies
+	ch <- e.descs.decodeErrors
+	ch <- e.descs.snmpRetries
+	ch <- e.descs.metricsStale
+	ch <- e.descs.collectDuration
+	ch <- e.descs.snmpRequests
+	ch <- e.descs.snmpErrors
+	ch <- e.descs.scrapeErrors
+	ch <- e.descs.lastScrapeError
+
+	systemTemperature, diskTemperature := e.temperatureDescs()
+
+	ch <- e.descs.systemStatus
 	ch <- systemTemperature
-	ch <- systemPowerStatus
-	ch <- systemFanStatus
-	ch <- systemCPUFanStatus
-	ch <- systemUpgradeAvailable
-
-	ch <- memTotalSwap
-	ch <- memAvailSwap
-	ch <- memTotalReal
-	ch <- memAvailReal
-	ch <- memTotalFree
-	ch <- memShared
-	ch <- memBuffer
-	ch <- memCached
-
-	ch <- loadShort
-	ch <- loadMid
-	ch <- loadLong
-
-	ch <- cpuUser
-	ch <- cpuNice
-	ch <- cpuSystem
-	ch <- cpuIdle
-	ch <- cpuWait
-	ch <- cpuKernel
-	ch <- cpuInterrupt
-
-	ch <- netIn
-	ch <- netOut
+	ch <- e.descs.systemPowerStatus
+	ch <- e.descs.systemFanStatus
+	ch <- e.descs.systemCPUFanStatus
+	ch <- e.descs.systemPowerOK
+	ch <- e.descs.systemFanOK
+	ch <- e.descs.systemCPUFanOK
+	ch <- e.descs.systemFanRPM
+	ch <- e.descs.systemUpgradeAvailable
+	ch <- e.descs.dsmUpdateAvailable
+	ch <- e.descs.systemUptime
+	ch <- e.descs.clockSkew
+
+	ch <- e.descs.memTotalSwap
+	ch <- e.descs.memAvailSwap
+	ch <- e.descs.memTotalReal
+	ch <- e.descs.memAvailReal
+	ch <- e.descs.memTotalFree
+	ch <- e.descs.memShared
+	ch <- e.descs.memBuffer
+	ch <- e.descs.memCached
+
+	ch <- e.descs.loadAverage
+	if e.Options.LegacyLoadMetrics {
+		ch <- e.descs.loadShort
+		ch <- e.descs.loadMid
+		ch <- e.descs.loadLong
+	}
+
+	ch <- e.descs.cpuUser
+	ch <- e.descs.cpuNice
+	ch <- e.descs.cpuSystem
+	ch <- e.descs.cpuIdle
+	ch <- e.descs.cpuWait
+	ch <- e.descs.cpuKernel
+	ch <- e.descs.cpuInterrupt
+	ch <- e.descs.cpuCoreLoad
+	ch <- e.descs.cpuUsage
+
+	ch <- diskTemperature
+	if e.Options.DiskTemperatureWarn != 0 {
+		ch <- e.descs.diskTemperatureExceeded
+	}
+	ch <- e.descs.diskInfo
+	ch <- e.descs.diskBadSectors
+	ch <- e.descs.diskCount
+	ch <- e.descs.diskIOReads
+	ch <- e.descs.diskIOWrites
+	ch <- e.descs.diskIOReadBytes
+	ch <- e.descs.diskIOWrittenBytes
+	ch <- e.descs.diskLoad
+
+	ch <- e.descs.netIn
+	ch <- e.descs.netOut
+	ch <- e.descs.netInterfaceBytes
+	ch <- e.descs.netInterfaceErrors
+	ch <- e.descs.netInterfaceDiscards
+	ch <- e.descs.netCounterWraps
+
+	ch <- e.descs.serviceConnections
+	ch <- e.descs.smbConnections
+	ch <- e.descs.nfsConnections
+	ch <- e.descs.afpConnections
+	ch <- e.descs.storageSize
+	ch <- e.descs.storageUsed
+	ch <- e.descs.volumeTotal
+	ch <- e.descs.volumeFree
+	ch <- e.descs.volumeCount
+	for _, desc := range e.descs.custom {
+		ch <- desc
+	}
 }
 
 // Collect fetches the stats from configured Syno location and delivers them
-// as Prometheus metrics.
+// as Prometheus metrics. When the scrape timeout expires, the metrics
+// already collected are delivered, with syno_up set to 0.
 // It implements prometheus.Collector.
 func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
-	log.Infof("Syno exporter starting")
+	log.Debugf("Syno exporter starting")
+	start := time.Now()
+	up := 1.0
+	var failures []error
+	defer func() {
+		ch <- prometheus.MustNewConstMetric(
+			e.descs.up, prometheus.GaugeValue, up,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			e.descs.scrapeDuration, prometheus.GaugeValue, time.Since(start).Seconds(),
+		)
+		lastError := 0.0
+		if len(failures) > 0 {
+			lastError = 1
+		}
+		ch <- prometheus.MustNewConstMetric(
+			e.descs.lastScrapeError, prometheus.GaugeValue, lastError,
+		)
+		e.mu.Lock()
+		e.lastScrape, e.lastErrors = start, failures
+		scrapeErrors := make(map[string]uint64, len(e.scrapeErrors))
+		for collector, count := range e.scrapeErrors {
+			scrapeErrors[collector] = count
+		}
+		e.mu.Unlock()
+		for collector, count := range scrapeErrors {
+			ch <- prometheus.MustNewConstMetric(
+				e.descs.scrapeErrors, prometheus.CounterValue, float64(count), collector,
+			)
+		}
+	}()
 	if e.Client == nil {
 		log.Errorf("Syno client not configured.")
+		up = 0
+		failures = append(failures, fmt.Errorf("Syno client not configured"))
 		return
 	}
 	err := e.Client.Connect()
 	if err != nil {
-		log.Errorln("Can't connect to Synology for SNMP: %s", err)
+		log.Errorf("Can't connect to Synology for SNMP: %s", err)
+		up = 0
+		failures = append(failures, fmt.Errorf("Can't connect to Synology for SNMP: %s", err))
 		return
 	}
-	defer e.Client.SNMP.Conn.Close()
 
-	e.collectSystemMetrics(ch)
-	e.collectCPUMetrics(ch)
-	e.collectLoadMetrics(ch)
-	e.collectMemoryMetrics(ch)
-	e.collectNetworkMetrics(ch)
-	e.collectDiskMetrics(ch)
+	ctx := e.ctx
+	if e.Options.ScrapeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.Options.ScrapeTimeout)
+		defer cancel()
+	}
+	ctx = e.Client.Prefetch(ctx)
+	if err := e.Client.Down(); err != nil {
+		// Logged once by the client, with how to fix it
+		log.Debugf("[syno] %s", err)
+		up = 0
+		failures = append(failures, err)
+		return
+	}
 
-	log.Infof("Syno exporter finished")
-}
+	// Each plugin is collected in its own goroutine: the number of plugins
+	// sending SNMP requests at the same time is bounded by the sessions of
+	// the client, so we don't flood the Diskstation SNMP agent.
+	collectors := []struct {
+		name    string
+		collect func(ctx context.Context, ch chan<- prometheus.Metric) error
+	}{
+		{"system", e.collectSystemMetrics},
+		{"cpu", e.collectCPUMetrics},
+		{"load", e.collectLoadMetrics},
+		{"mem", e.collectMemoryMetrics},
+		{"net", e.collectNetworkMetrics},
+		{"disk", e.collectDiskMetrics},
+		{"diskio", e.collectDiskIOMetrics},
+		{"service", e.collectServiceMetrics},
+		{"storage", e.collectStorageMetrics},
+		{"space", e.collectSpaceMetrics},
+		{"custom", e.collectCustomMetrics},
+	}
+	errs := make([]error, len(collectors))
+	var wg sync.WaitGroup
+	for i, collector := range collectors {
+		if _, ok := e.Client.Plugins[collector.name]; !ok {
+			continue
+		}
+		// Exported from the first collection, before any error
+		e.countScrapeErrors(collector.name, 0)
+		wg.Add(1)
+		go func(i int, collect func(ctx context.Context, ch chan<- prometheus.Metric) error) {
+			defer wg.Done()
+			errs[i] = collect(ctx, ch)
+		}(i, collector.collect)
+	}
+	wg.Wait()
 
-func (e *Exporter) collectSystemMetrics(ch chan<- prometheus.Metric) {
-	resp, err := e.Client.SystemMetrics()
-	if err != nil {
-		log.Errorf("[syno] Can't retrieve system metrics: %v", err)
-		return
+	for i, collector := range collectors {
+		if _, ok := e.Client.Plugins[collector.name]; !ok {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(
+			e.descs.collectDuration, prometheus.GaugeValue, e.Client.Duration(collector.name).Seconds(), collector.name,
+		)
+		if err := errs[i]; err != nil {
+			e.countScrapeErrors(collector.name, 1)
+			log.Errorf("[syno] %s", err)
+			up = 0
+			failures = append(failures, err)
+			continue
+		}
+		stale := 0.0
+		if e.Client.Stale(collector.name) {
+			stale = 1
+		}
+		ch <- prometheus.MustNewConstMetric(
+			e.descs.metricsStale, prometheus.GaugeValue, stale, collector.name,
+		)
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		log.Errorf("[syno] Collection from %s timed out after %s", e.Client.Diskstation, e.Options.ScrapeTimeout)
+		failures = append(failures, fmt.Errorf("Collection timed out after %s", e.Options.ScrapeTimeout))
 	}
-	log.Infof("SNMP System metrics: %v", resp)
 
 	ch <- prometheus.MustNewConstMetric(
-		systemStatus, prometheus.GaugeValue, resp["system-status"],
+		e.descs.snmpReconnects, prometheus.CounterValue, float64(e.Client.Reconnects()),
 	)
 	ch <- prometheus.MustNewConstMetric(
-		systemTemperature, prometheus.GaugeValue, resp["system-temperature"],
+		e.descs.walkAnomalies, prometheus.CounterValue, float64(e.Client.WalkAnomalies()),
 	)
 	ch <- prometheus.MustNewConstMetric(
-		systemPowerStatus, prometheus.GaugeValue, resp["system-powerStatus"],
+		e.descs.decodeErrors, prometheus.CounterValue, float64(e.Client.DecodeErrors()),
 	)
 	ch <- prometheus.MustNewConstMetric(
-		systemFanStatus, prometheus.GaugeValue, resp["system-systemFanStatus"],
-	)
-	ch <- prometheus.MustNewConstMetric(
-		systemCPUFanStatus, prometheus.GaugeValue, resp["system-cpuFanStatus"],
-	)
-	ch <- prometheus.MustNewConstMetric(
-		systemUpgradeAvailable, prometheus.GaugeValue, resp["system-upgradeAvailable"],
+		e.descs.snmpRetries, prometheus.CounterValue, float64(e.Client.SNMPRetries()),
 	)
+	requests, errors := e.Client.Requests()
+	for request, count := range requests {
+		ch <- prometheus.MustNewConstMetric(
+			e.descs.snmpRequests, prometheus.CounterValue, float64(count), request.Plugin, request.Type,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			e.descs.snmpErrors, prometheus.CounterValue, float64(errors[request]), request.Plugin, request.Type,
+		)
+	}
+	log.Debugf("Syno exporter finished")
 }
 
-func (e *Exporter) collectDiskMetrics(ch chan<- prometheus.Metric) {
-	resp, err := e.Client.DiskMetrics()
+// countScrapeErrors adds to the number of failed collections of a collector
+func (e *Exporter) countScrapeErrors(collector string, errors uint64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.scrapeErrors[collector] += errors
+}
+
+func (e *Exporter) collectSystemMetrics(ctx context.Context, ch chan<- prometheus.Metric) error {
+	resp, err := e.Client.SystemMetrics(ctx)
 	if err != nil {
-		log.Errorf("[syno] Can't retrieve Disk metrics: %v", err)
-		return
+		return fmt.Errorf("Can't retrieve system metrics: %s", err)
 	}
-	log.Infof("SNMP Disk metrics: %v", resp)
+	log.Debugf("SNMP System metrics: %+v", resp)
+	systemTemperature, _ := e.temperatureDescs()
 
+	sendMetric(ch, e.descs.systemStatus, prometheus.GaugeValue, resp.Status)
+	if resp.Temperature != nil {
+		ch <- prometheus.MustNewConstMetric(
+			systemTemperature, prometheus.GaugeValue, e.temperature(*resp.Temperature),
+		)
+	}
+	sendMetric(ch, e.descs.systemPowerStatus, prometheus.GaugeValue, resp.PowerStatus)
+	sendMetric(ch, e.descs.systemFanStatus, prometheus.GaugeValue, resp.SystemFanStatus)
+	sendMetric(ch, e.descs.systemCPUFanStatus, prometheus.GaugeValue, resp.CPUFanStatus)
+	sendStatusOK(ch, e.descs.systemPowerOK, resp.PowerStatus)
+	for fan, value := range resp.Fans {
+		value := value
+		sendStatusOK(ch, e.descs.systemFanOK, &value, fan)
+	}
+	sendStatusOK(ch, e.descs.systemCPUFanOK, resp.CPUFanStatus)
+	for fan, speed := range resp.FanSpeeds {
+		ch <- prometheus.MustNewConstMetric(e.descs.systemFanRPM, prometheus.GaugeValue, speed, fan)
+	}
+	sendMetric(ch, e.descs.systemUpgradeAvailable, prometheus.GaugeValue, resp.UpgradeAvailable)
+	if resp.UpgradeAvailable != nil {
+		switch *resp.UpgradeAvailable {
+		case plugins.UpgradeAvailable:
+			ch <- prometheus.MustNewConstMetric(e.descs.dsmUpdateAvailable, prometheus.GaugeValue, 1)
+		case plugins.UpgradeUnavailable:
+			ch <- prometheus.MustNewConstMetric(e.descs.dsmUpdateAvailable, prometheus.GaugeValue, 0)
+		}
+	}
+	sendMetric(ch, e.descs.systemUptime, prometheus.GaugeValue, resp.Uptime)
+	sendMetric(ch, e.descs.clockSkew, prometheus.GaugeValue, resp.ClockSkew)
+	return nil
 }
 
-func (e *Exporter) collectLoadMetrics(ch chan<- prometheus.Metric) {
-	resp, err := e.Client.LoadMetrics()
+func (e *Exporter) collectDiskMetrics(ctx context.Context, ch chan<- prometheus.Metric) error {
+	resp, err := e.Client.DiskMetrics(ctx)
 	if err != nil {
-		log.Errorf("[syno] Can't retrieve Load metrics: %v", err)
-		return
+		return fmt.Errorf("Can't retrieve Disk metrics: %s", err)
 	}
-	log.Infof("SNMP Load response: %s", resp)
-	ch <- prometheus.MustNewConstMetric(
-		loadShort, prometheus.GaugeValue, resp["load.shortterm"],
-	)
-	ch <- prometheus.MustNewConstMetric(
-		loadMid, prometheus.GaugeValue, resp["load.midterm"],
-	)
-	ch <- prometheus.MustNewConstMetric(
-		loadLong, prometheus.GaugeValue, resp["load.longterm"],
-	)
+	log.Debugf("SNMP Disk metrics: %+v", resp)
+	_, diskTemperature := e.temperatureDescs()
+
+	// Each disk has an info metric
+	disks := 0
+	for index, disk := range resp.Disks {
+		if disk.Temperature != nil {
+			temperature := e.temperature(*disk.Temperature)
+			ch <- prometheus.MustNewConstMetric(
+				diskTemperature, prometheus.GaugeValue, temperature, index,
+			)
+			if e.Options.DiskTemperatureWarn != 0 {
+				exceeded := 0.0
+				if temperature > e.Options.DiskTemperatureWarn {
+					exceeded = 1
+				}
+				ch <- prometheus.MustNewConstMetric(
+					e.descs.diskTemperatureExceeded, prometheus.GaugeValue, exceeded, index,
+				)
+			}
+		}
+		sendMetric(ch, e.descs.diskBadSectors, prometheus.GaugeValue, disk.BadSectors, index)
+		if disk.Info != nil {
+			ch <- prometheus.MustNewConstMetric(
+				e.descs.diskInfo, prometheus.GaugeValue, 1,
+				index, disk.Info.ID, disk.Info.Model, disk.Info.Enclosure,
+			)
+			disks++
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(e.descs.diskCount, prometheus.GaugeValue, float64(disks))
+	return nil
 }
 
-func (e *Exporter) collectCPUMetrics(ch chan<- prometheus.Metric) {
-	resp, err := e.Client.CPUMetrics()
+func (e *Exporter) collectDiskIOMetrics(ctx context.Context, ch chan<- prometheus.Metric) error {
+	resp, err := e.Client.DiskIOMetrics(ctx)
 	if err != nil {
-		log.Errorf("[syno] Can't retrieve CPU metrics: %v", err)
-		return
+		return fmt.Errorf("Can't retrieve Disk IO metrics: %s", err)
 	}
-	log.Infof("SNMP CPU response: %s", resp)
-	ch <- prometheus.MustNewConstMetric(
-		cpuUser, prometheus.GaugeValue, resp["cpu-0.cpu-user"],
-	)
-	ch <- prometheus.MustNewConstMetric(
-		cpuNice, prometheus.GaugeValue, resp["cpu-0.cpu-nice"],
-	)
-	ch <- prometheus.MustNewConstMetric(
-		cpuSystem, prometheus.GaugeValue, resp["cpu-0.cpu-system"],
-	)
-	ch <- prometheus.MustNewConstMetric(
-		cpuIdle, prometheus.GaugeValue, resp["cpu-0.cpu-idle"],
-	)
-	ch <- prometheus.MustNewConstMetric(
-		cpuWait, prometheus.GaugeValue, resp["cpu-0.cpu-wait"],
-	)
-	ch <- prometheus.MustNewConstMetric(
-		cpuKernel, prometheus.GaugeValue, resp["cpu-0.cpu-kernel"],
-	)
-	ch <- prometheus.MustNewConstMetric(
-		cpuInterrupt, prometheus.GaugeValue, resp["cpu-0.cpu-interrupt"],
-	)
+	log.Debugf("SNMP Disk IO metrics: %+v", resp)
+	for device, io := range resp.Devices {
+		sendMetric(ch, e.descs.diskIOReads, prometheus.CounterValue, io.Reads, device)
+		sendMetric(ch, e.descs.diskIOWrites, prometheus.CounterValue, io.Writes, device)
+		sendMetric(ch, e.descs.diskIOReadBytes, prometheus.CounterValue, io.ReadBytes, device)
+		sendMetric(ch, e.descs.diskIOWrittenBytes, prometheus.CounterValue, io.WrittenBytes, device)
+		sendMetric(ch, e.descs.diskLoad, prometheus.GaugeValue, io.Load, device)
+	}
+	return nil
 }
 
-func (e *Exporter) collectMemoryMetrics(ch chan<- prometheus.Metric) {
-	resp, err := e.Client.MemoryMetrics()
+func (e *Exporter) collectServiceMetrics(ctx context.Context, ch chan<- prometheus.Metric) error {
+	resp, err := e.Client.ServiceMetrics(ctx)
 	if err != nil {
-		log.Errorf("[syno] Can't retrieve Memory metrics: %v", err)
-		return
+		return fmt.Errorf("Can't retrieve Service metrics: %s", err)
 	}
-	log.Infof("SNMP Memory response: %s", resp)
-	ch <- prometheus.MustNewConstMetric(
-		memTotalSwap, prometheus.GaugeValue, resp["mem-total-swap"],
-	)
-	ch <- prometheus.MustNewConstMetric(
-		memAvailSwap, prometheus.GaugeValue, resp["mem-avail-swap"],
-	)
-	ch <- prometheus.MustNewConstMetric(
-		memTotalReal, prometheus.GaugeValue, resp["mem-total-real"],
-	)
-	ch <- prometheus.MustNewConstMetric(
-		memAvailReal, prometheus.GaugeValue, resp["mem-avail-real"],
-	)
-	ch <- prometheus.MustNewConstMetric(
-		memTotalFree, prometheus.GaugeValue, resp["mem-total-free"],
-	)
-	ch <- prometheus.MustNewConstMetric(
-		memShared, prometheus.GaugeValue, resp["mem-shared"],
-	)
-	ch <- prometheus.MustNewConstMetric(
-		memBuffer, prometheus.GaugeValue, resp["mem-buffer"],
-	)
-	ch <- prometheus.MustNewConstMetric(
-		memCached, prometheus.GaugeValue, resp["mem-cached"],
-	)
+	log.Debugf("SNMP Service metrics: %+v", resp)
+	for service, connections := range resp.Connections {
+		ch <- prometheus.MustNewConstMetric(
+			e.descs.serviceConnections, prometheus.GaugeValue, connections, service,
+		)
+	}
+	sendMetric(ch, e.descs.smbConnections, prometheus.GaugeValue, resp.SMB)
+	sendMetric(ch, e.descs.nfsConnections, prometheus.GaugeValue, resp.NFS)
+	sendMetric(ch, e.descs.afpConnections, prometheus.GaugeValue, resp.AFP)
+	return nil
 }
 
-func (e *Exporter) collectNetworkMetrics(ch chan<- prometheus.Metric) {
-	resp, err := e.Client.NetworkMetrics()
+func (e *Exporter) collectSpaceMetrics(ctx context.Context, ch chan<- prometheus.Metric) error {
+	resp, err := e.Client.SpaceMetrics(ctx)
 	if err != nil {
-		log.Errorf("[syno] Can't retrieve Network metrics: %v", err)
-		return
+		return fmt.Errorf("Can't retrieve Space metrics: %s", err)
 	}
-	log.Infof("SNMP Network response: %s", resp)
-	ch <- prometheus.MustNewConstMetric(
-		netIn, prometheus.GaugeValue, resp["net-in"],
-	)
+	log.Debugf("SNMP Space metrics: %+v", resp)
+	volumes := 0
+	for name, volume := range resp.Volumes {
+		sendMetric(ch, e.descs.volumeTotal, prometheus.GaugeValue, volume.Total, name)
+		sendMetric(ch, e.descs.volumeFree, prometheus.GaugeValue, volume.Free, name)
+		if volume.Total != nil {
+			volumes++
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(e.descs.volumeCount, prometheus.GaugeValue, float64(volumes))
+	return nil
+}
+
+func (e *Exporter) collectStorageMetrics(ctx context.Context, ch chan<- prometheus.Metric) error {
+	resp, err := e.Client.StorageMetrics(ctx)
+	if err != nil {
+		return fmt.Errorf("Can't retrieve Storage metrics: %s", err)
+	}
+	log.Debugf("SNMP Storage metrics: %+v", resp)
+	for _, area := range resp.Areas {
+		// Labeled with the storage description, type and filesystem type
+		sendMetric(ch, e.descs.storageSize, prometheus.GaugeValue, area.Size, area.Description, area.Type, area.FSType)
+		sendMetric(ch, e.descs.storageUsed, prometheus.GaugeValue, area.Used, area.Description, area.Type, area.FSType)
+	}
+	return nil
+}
+
+func (e *Exporter) collectCustomMetrics(ctx context.Context, ch chan<- prometheus.Metric) error {
+	resp, err := e.Client.CustomMetrics(ctx)
+	if err != nil {
+		return fmt.Errorf("Can't retrieve Custom metrics: %s", err)
+	}
+	log.Debugf("SNMP Custom metrics: %+v", resp)
+	plugin := e.Client.Plugins["custom"].(plugins.CustomPlugin)
+	for name, values := range resp.Values {
+		desc, ok := e.descs.custom[name]
+		if !ok {
+			return fmt.Errorf("Can't export Custom metrics: unknown metric %s", name)
+		}
+		for _, value := range values {
+			var labels []string
+			if !plugin.Scalar(name) {
+				labels = []string{value.Index}
+			}
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value.Value, labels...)
+		}
+	}
+	return nil
+}
+
+func (e *Exporter) collectLoadMetrics(ctx context.Context, ch chan<- prometheus.Metric) error {
+	resp, err := e.Client.LoadMetrics(ctx)
+	if err != nil {
+		return fmt.Errorf("Can't retrieve Load metrics: %s", err)
+	}
+	log.Debugf("SNMP Load response: %+v", resp)
+	sendMetric(ch, e.descs.loadAverage, prometheus.GaugeValue, resp.Short, "1m")
+	sendMetric(ch, e.descs.loadAverage, prometheus.GaugeValue, resp.Mid, "5m")
+	sendMetric(ch, e.descs.loadAverage, prometheus.GaugeValue, resp.Long, "15m")
+	if e.Options.LegacyLoadMetrics {
+		sendMetric(ch, e.descs.loadShort, prometheus.GaugeValue, resp.Short)
+		sendMetric(ch, e.descs.loadMid, prometheus.GaugeValue, resp.Mid)
+		sendMetric(ch, e.descs.loadLong, prometheus.GaugeValue, resp.Long)
+	}
+	return nil
+}
+
+func (e *Exporter) collectCPUMetrics(ctx context.Context, ch chan<- prometheus.Metric) error {
+	resp, err := e.Client.CPUMetrics(ctx)
+	if err != nil {
+		return fmt.Errorf("Can't retrieve CPU metrics: %s", err)
+	}
+	log.Debugf("SNMP CPU response: %+v", resp)
+	sendMetric(ch, e.descs.cpuUser, prometheus.CounterValue, resp.User)
+	sendMetric(ch, e.descs.cpuNice, prometheus.CounterValue, resp.Nice)
+	sendMetric(ch, e.descs.cpuSystem, prometheus.CounterValue, resp.System)
+	sendMetric(ch, e.descs.cpuIdle, prometheus.CounterValue, resp.Idle)
+	sendMetric(ch, e.descs.cpuWait, prometheus.CounterValue, resp.Wait)
+	sendMetric(ch, e.descs.cpuKernel, prometheus.CounterValue, resp.Kernel)
+	sendMetric(ch, e.descs.cpuInterrupt, prometheus.CounterValue, resp.Interrupt)
+	if usage, ok := e.cpuUsage(resp); ok {
+		ch <- prometheus.MustNewConstMetric(e.descs.cpuUsage, prometheus.GaugeValue, usage)
+	}
+	for core, load := range resp.Cores {
+		ch <- prometheus.MustNewConstMetric(
+			e.descs.cpuCoreLoad, prometheus.GaugeValue, load, strconv.Itoa(core),
+		)
+	}
+	return nil
+}
+
+// cpuTicks returns the CPU tick counters adding up to the total CPU time, the
+// idle ones first: ssCpuRawSystem already includes the kernel and interrupt
+// ticks.
+func cpuTicks(resp *plugins.CPUMetrics) []*float64 {
+	return []*float64{resp.Idle, resp.User, resp.Nice, resp.System, resp.Wait}
+}
+
+// cpuUsage returns the percentage of the CPU ticks which weren't idle since
+// the previous scrape, and remembers the ticks for the next one. It returns
+// false on the first scrape, or when a counter is missing or wrapped.
+func (e *Exporter) cpuUsage(resp *plugins.CPUMetrics) (float64, bool) {
+	var ticks []float64
+	for _, value := range cpuTicks(resp) {
+		if value == nil {
+			return 0, false
+		}
+		ticks = append(ticks, *value)
+	}
+
+	e.mu.Lock()
+	previous := e.cpuTicks
+	e.cpuTicks = ticks
+	e.mu.Unlock()
+	if previous == nil {
+		return 0, false
+	}
+
+	var total float64
+	for i := range ticks {
+		delta := ticks[i] - previous[i]
+		if delta < 0 {
+			return 0, false
+		}
+		total += delta
+	}
+	if total == 0 {
+		return 0, false
+	}
+	idle := ticks[0] - previous[0]
+	return 100 * (total - idle) / total, true
+}
+
+func (e *Exporter) collectMemoryMetrics(ctx context.Context, ch chan<- prometheus.Metric) error {
+	resp, err := e.Client.MemoryMetrics(ctx)
+	if err != nil {
+		return fmt.Errorf("Can't retrieve Memory metrics: %s", err)
+	}
+	log.Debugf("SNMP Memory response: %+v", resp)
+	sendMetric(ch, e.descs.memTotalSwap, prometheus.GaugeValue, resp.TotalSwap)
+	sendMetric(ch, e.descs.memAvailSwap, prometheus.GaugeValue, resp.AvailSwap)
+	sendMetric(ch, e.descs.memTotalReal, prometheus.GaugeValue, resp.TotalReal)
+	sendMetric(ch, e.descs.memAvailReal, prometheus.GaugeValue, resp.AvailReal)
+	sendMetric(ch, e.descs.memTotalFree, prometheus.GaugeValue, resp.TotalFree)
+	sendMetric(ch, e.descs.memShared, prometheus.GaugeValue, resp.Shared)
+	sendMetric(ch, e.descs.memBuffer, prometheus.GaugeValue, resp.Buffer)
+	sendMetric(ch, e.descs.memCached, prometheus.GaugeValue, resp.Cached)
+	return nil
+}
+
+func (e *Exporter) collectNetworkMetrics(ctx context.Context, ch chan<- prometheus.Metric) error {
+	resp, err := e.Client.NetworkMetrics(ctx)
+	if err != nil {
+		return fmt.Errorf("Can't retrieve Network metrics: %s", err)
+	}
+	log.Debugf("SNMP Network response: %+v", resp)
+	ch <- prometheus.MustNewConstMetric(e.descs.netIn, prometheus.GaugeValue, resp.In)
+	ch <- prometheus.MustNewConstMetric(e.descs.netOut, prometheus.GaugeValue, resp.Out)
 	ch <- prometheus.MustNewConstMetric(
-		netOut, prometheus.GaugeValue, resp["net-out"],
+		e.descs.netCounterWraps, prometheus.CounterValue, float64(e.Client.CounterWraps()),
 	)
+	for name, counters := range resp.Interfaces {
+		sendMetric(ch, e.descs.netInterfaceBytes, prometheus.CounterValue, counters.InOctets, name, "in")
+		sendMetric(ch, e.descs.netInterfaceBytes, prometheus.CounterValue, counters.OutOctets, name, "out")
+		sendMetric(ch, e.descs.netInterfaceErrors, prometheus.CounterValue, counters.InErrors, name, "in")
+		sendMetric(ch, e.descs.netInterfaceErrors, prometheus.CounterValue, counters.OutErrors, name, "out")
+		sendMetric(ch, e.descs.netInterfaceDiscards, prometheus.CounterValue, counters.InDiscards, name, "in")
+		sendMetric(ch, e.descs.netInterfaceDiscards, prometheus.CounterValue, counters.OutDiscards, name, "out")
+	}
+	return nil
+}
+
+// sendMetric sends a value returned by a plugin. Nothing is sent if it's nil,
+// e.g. when the Diskstation doesn't support it.
+func sendMetric(ch chan<- prometheus.Metric, desc *prometheus.Desc, valueType prometheus.ValueType, value *float64, labels ...string) {
+	if value != nil {
+		ch <- prometheus.MustNewConstMetric(desc, valueType, *value, labels...)
+	}
+}
+
+// sendStatusOK sends 1 if the status enum is normal, 0 otherwise. Nothing is
+// sent if it's nil.
+func sendStatusOK(ch chan<- prometheus.Metric, desc *prometheus.Desc, value *float64, labels ...string) {
+	if value != nil {
+		status := 0.0
+		if *value == plugins.StatusNormal {
+			status = 1
+		}
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, status, labels...)
+	}
+}
+
+// snmpHandler probes the Diskstation given by the 'target' query parameter,
+// using the optional 'community' one, and writes its metrics. Settings of
+// targets defined in the configuration file are used.
+func snmpHandler(cfg *config.Config, opts Options) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		diskstation := r.URL.Query().Get("target")
+		if diskstation == "" {
+			http.Error(w, "'target' parameter must be specified", http.StatusBadRequest)
+			return
+		}
+		target := config.Target{Diskstation: diskstation}
+		if t := cfg.Target(diskstation); t != nil {
+			target = *t
+		}
+		if community := r.URL.Query().Get("community"); community != "" {
+			target.Community = community
+		}
+		client, err := syno.NewClientFromConfig(&target)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Can't create the Syno client: %s", err), http.StatusBadRequest)
+			return
+		}
+		defer client.Close()
+
+		log.Debugf("Probe Diskstation: %s", diskstation)
+		registry := prometheus.NewRegistry()
+		exporter := newExporter(client, target.Name, opts)
+		exporter.ctx = r.Context()
+		registry.MustRegister(exporter)
+		metricsHandler(registry).ServeHTTP(w, r)
+	}
+}
+
+// LastScrape returns when the last collection started, and its errors.
+// The time is zero if there was none yet.
+func (e *Exporter) LastScrape() (time.Time, []error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.lastScrape, e.lastErrors
+}
+
+var landingTemplate = template.Must(template.New("landing").Parse(`<html>
+             <head><title>Syno Exporter</title></head>
+             <body>
+             <h1>Syno Exporter</h1>
+             <p><a href='.{{.MetricsPath}}'>Metrics</a></p>
+             {{range .Diskstations}}
+             <h2>Diskstation {{.Name}}</h2>
+             {{if .LastScrape.IsZero}}
+             <p>Not scraped yet.</p>
+             {{else if .Errors}}
+             <p>Last scrape at {{.LastScrape.Format "2006-01-02 15:04:05 MST"}} failed:</p>
+             <ul>{{range .Errors}}<li>{{.}}</li>{{end}}</ul>
+             {{else}}
+             <p>Last scrape at {{.LastScrape.Format "2006-01-02 15:04:05 MST"}} succeeded.</p>
+             {{end}}
+             {{end}}
+             {{if .Metrics}}
+             <h2>Metrics</h2>
+             <table>
+             <tr><th>Name</th><th>Labels</th><th>Help</th></tr>
+             {{range .Metrics}}<tr><td><code>{{.Name}}</code></td><td>{{.Labels}}</td><td>{{.Help}}</td></tr>
+             {{end}}</table>
+             {{end}}
+             </body>
+             </html>`))
+
+// metricHelp describes an exported metric on the landing page
+type metricHelp struct {
+	Name   string
+	Labels string
+	Help   string
+}
+
+// describeMetrics returns the metrics described by the exporter, sorted by
+// name.
+func describeMetrics(exporter *Exporter) []metricHelp {
+	ch := make(chan *prometheus.Desc)
+	go func() {
+		exporter.Describe(ch)
+		close(ch)
+	}()
+	var metrics []metricHelp
+	for desc := range ch {
+		if metric, ok := exporter.descs.help[desc]; ok {
+			metrics = append(metrics, metric)
+		}
+	}
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].Name < metrics[j].Name })
+	return metrics
+}
+
+// landingHandler renders the landing page, with the status of the last
+// collection from each Diskstation and the metrics exported. The link to the
+// metrics is relative to the page, so it works behind a reverse proxy serving
+// the exporter under another path.
+func landingHandler(exporters []*Exporter, metricsPath string) http.HandlerFunc {
+	type diskstation struct {
+		Name       string
+		LastScrape time.Time
+		Errors     []error
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		data := struct {
+			MetricsPath  string
+			Diskstations []diskstation
+			Metrics      []metricHelp
+		}{MetricsPath: metricsPath}
+		for _, exporter := range exporters {
+			status := diskstation{Name: exporter.Client.Diskstation}
+			status.LastScrape, status.Errors = exporter.LastScrape()
+			data.Diskstations = append(data.Diskstations, status)
+		}
+		if len(exporters) > 0 {
+			data.Metrics = describeMetrics(exporters[0])
+		}
+		if err := landingTemplate.Execute(w, data); err != nil {
+			log.Errorf("Can't render the landing page: %s", err)
+		}
+	}
+}
+
+// healthzHandler checks that the exporter can reach the Diskstations
+func healthzHandler(exporters []*Exporter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var failures []string
+		for _, exporter := range exporters {
+			if err := exporter.Client.Ping(); err != nil {
+				failures = append(failures, fmt.Sprintf("Can't reach the Diskstation %s: %s", exporter.Client.Diskstation, err))
+			}
+		}
+		if len(failures) > 0 {
+			http.Error(w, strings.Join(failures, "\n"), http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("OK"))
+	}
+}
+
+// singleTarget returns the Diskstation exported on the metrics path: the one
+// given by the flags, merged with its entry of the configuration file.
+// Flags explicitly set override the configuration file.
+func singleTarget(cfg *config.Config, flags config.Target) *config.Target {
+	target := config.Target{Diskstation: flags.Diskstation}
+	if t := cfg.Target(flags.Diskstation); t != nil {
+		target = *t
+	} else if flags.Diskstation == "" && len(cfg.Targets) == 1 {
+		target = cfg.Targets[0]
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "instance-name":
+			target.Name = flags.Name
+		case "snmp.community":
+			target.Community = flags.Community
+		case "snmp.version":
+			target.Version = flags.Version
+		case "snmp.transport":
+			target.Transport = flags.Transport
+		case "snmp.local-address":
+			target.LocalAddress = flags.LocalAddress
+		case "interval":
+			target.Interval = flags.Interval
+		case "snmp.resolve-interval":
+			target.ResolveInterval = flags.ResolveInterval
+		case "snmp.max-repetitions":
+			target.MaxRepetitions = flags.MaxRepetitions
+		case "snmp.non-repeaters":
+			target.NonRepeaters = flags.NonRepeaters
+		case "snmp.max-oids":
+			target.MaxOids = flags.MaxOids
+		case "snmp.retries":
+			target.Retries = flags.Retries
+		case "snmp.skip-not-increasing":
+			target.SkipNotIncreasing = flags.SkipNotIncreasing
+		case "snmp.v3-username":
+			target.V3.Username = flags.V3.Username
+		case "snmp.v3-auth-protocol":
+			target.V3.AuthProtocol = flags.V3.AuthProtocol
+		case "snmp.v3-auth-password":
+			target.V3.AuthPassword = flags.V3.AuthPassword
+		case "snmp.v3-priv-protocol":
+			target.V3.PrivProtocol = flags.V3.PrivProtocol
+		case "snmp.v3-priv-password":
+			target.V3.PrivPassword = flags.V3.PrivPassword
+		case "snmp.v3-context-name":
+			target.V3.ContextName = flags.V3.ContextName
+		case "snmp.v3-context-engine-id":
+			target.V3.ContextEngineID = flags.V3.ContextEngineID
+		case "cpu.per-core":
+			target.CPUPerCore = flags.CPUPerCore
+		case "net.per-interface":
+			target.NetPerInterface = flags.NetPerInterface
+		case "system.fan-speed":
+			target.SystemFanSpeed = flags.SystemFanSpeed
+		case "collectors":
+			target.Plugins = flags.Plugins
+		case "custom.oid":
+			target.CustomOIDs = flags.CustomOIDs
+		case "oid.base":
+			target.OIDBases = flags.OIDBases
+		}
+	})
+	return &target
+}
+
+// parseCollectors splits the comma-separated list of collectors
+func parseCollectors(collectors string) []string {
+	var names []string
+	for _, name := range strings.Split(collectors, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// parseDiskstations splits the comma-separated list of Diskstations. It's
+// [""] if there is none, for the Diskstation of the configuration file.
+func parseDiskstations(diskstations string) []string {
+	names := parseCollectors(diskstations)
+	if len(names) == 0 {
+		return []string{""}
+	}
+	return names
+}
+
+// normalizePrefix returns the route prefix with a leading slash and without
+// a trailing one, so the paths of the endpoints can be appended to it. The
+// root prefix is "".
+func normalizePrefix(prefix string) string {
+	return strings.TrimSuffix("/"+strings.Trim(prefix, "/"), "/")
 }
 
 func init() {
-	prometheus.MustRegister(prom_version.NewCollector("syno_exporter"))
+	// The build information is set by the Makefile. Builds without it
+	// still report the application version.
+	if prom_version.Version == "" {
+		prom_version.Version = version.Version
+	}
+}
+
+// versionHandler returns the build information in JSON.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Version   string `json:"version"`
+		Revision  string `json:"revision"`
+		Branch    string `json:"branch"`
+		BuildUser string `json:"build_user"`
+		BuildDate string `json:"build_date"`
+		GoVersion string `json:"go_version"`
+	}{
+		Version:   prom_version.Version,
+		Revision:  prom_version.Revision,
+		Branch:    prom_version.Branch,
+		BuildUser: prom_version.BuildUser,
+		BuildDate: prom_version.BuildDate,
+		GoVersion: prom_version.GoVersion,
+	})
+}
+
+// redacted replaces the secrets of the configuration shown by /config
+const redacted = "<secret>"
+
+// redact hides a secret, but shows whether it's set
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redacted
+}
+
+// diskstationConfig is the effective configuration of an exported
+// Diskstation, as shown by /config
+type diskstationConfig struct {
+	Diskstation       string            `json:"diskstation"`
+	Name              string            `json:"name,omitempty"`
+	Target            string            `json:"target"`
+	Community         string            `json:"community,omitempty"`
+	Version           string            `json:"version"`
+	Transport         string            `json:"transport"`
+	LocalAddress      string            `json:"local_address,omitempty"`
+	V3                *config.V3        `json:"v3,omitempty"`
+	Interval          string            `json:"interval"`
+	ResolveInterval   string            `json:"resolve_interval"`
+	CacheMaxAge       string            `json:"cache_max_age"`
+	FetchRetries      int               `json:"fetch_retries"`
+	Concurrency       int               `json:"concurrency"`
+	MaxRepetitions    uint8             `json:"max_repetitions"`
+	NonRepeaters      int               `json:"non_repeaters"`
+	MaxOids           int               `json:"max_oids"`
+	Retries           int               `json:"retries"`
+	Collectors        []string          `json:"collectors"`
+	CPUPerCore        bool              `json:"cpu_per_core"`
+	NetPerInterface   bool              `json:"net_per_interface"`
+	SystemFanSpeed    bool              `json:"system_fan_speed"`
+	SkipNotIncreasing bool              `json:"skip_not_increasing"`
+	OIDBases          map[string]string `json:"oid_bases,omitempty"`
+	CustomOIDs        map[string]string `json:"custom_oids,omitempty"`
+}
+
+// newDiskstationConfig returns the configuration of the Diskstation of the
+// exporter, with the secrets redacted.
+func newDiskstationConfig(exporter *Exporter) diskstationConfig {
+	client := exporter.Client
+	cfg := diskstationConfig{
+		Diskstation:     client.Diskstation,
+		Target:          net.JoinHostPort(client.SNMP.Target, strconv.Itoa(int(client.SNMP.Port))),
+		Community:       redact(client.SNMP.Community),
+		Version:         client.SNMP.Version.String(),
+		Transport:       client.SNMP.Transport,
+		LocalAddress:    client.SNMP.LocalAddr,
+		Interval:        client.Interval.String(),
+		ResolveInterval: client.ResolveInterval.String(),
+		CacheMaxAge:     client.CacheMaxAge.String(),
+		FetchRetries:    client.FetchRetries,
+		Concurrency:     client.Concurrency,
+		MaxRepetitions:  client.SNMP.MaxRepetitions,
+		NonRepeaters:    client.SNMP.NonRepeaters,
+		MaxOids:         client.SNMP.MaxOids,
+		Retries:         client.SNMP.Retries,
+		Collectors:      client.PluginNames(),
+	}
+	if cfg.Transport == "" {
+		cfg.Transport = "udp"
+	}
+	if target := exporter.Target; target != nil {
+		cfg.Name = target.Name
+		cfg.CPUPerCore = target.CPUPerCore
+		cfg.NetPerInterface = target.NetPerInterface
+		cfg.SystemFanSpeed = target.SystemFanSpeed
+		cfg.SkipNotIncreasing = target.SkipNotIncreasing
+		cfg.OIDBases = target.OIDBases
+		cfg.CustomOIDs = target.CustomOIDs
+		if client.SNMP.Version == gosnmp.Version3 {
+			cfg.Community = ""
+			cfg.V3 = &config.V3{
+				Username:     target.V3.Username,
+				AuthProtocol: target.V3.AuthProtocol,
+				AuthPassword: redact(target.V3.AuthPassword),
+				PrivProtocol: target.V3.PrivProtocol,
+				PrivPassword: redact(target.V3.PrivPassword),
+
+				ContextName:     target.V3.ContextName,
+				ContextEngineID: target.V3.ContextEngineID,
+			}
+		}
+	}
+	return cfg
+}
+
+// configHandler returns in JSON the effective configuration of the
+// exporter: the exported Diskstations, once the flags and the configuration
+// file are merged, and the options. The secrets are redacted.
+func configHandler(cfg *config.Config, exporters []*Exporter, opts Options) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		effective := struct {
+			Diskstations        []diskstationConfig `json:"diskstations"`
+			ProbeTargets        []string            `json:"probe_targets"`
+			Namespace           string              `json:"namespace"`
+			Fahrenheit          bool                `json:"fahrenheit"`
+			ScrapeTimeout       string              `json:"scrape_timeout"`
+			LegacyLoadMetrics   bool                `json:"legacy_load_metrics"`
+			DiskTemperatureWarn float64             `json:"disk_temperature_warn"`
+		}{
+			Diskstations:        []diskstationConfig{},
+			ProbeTargets:        []string{},
+			Namespace:           opts.Namespace,
+			Fahrenheit:          opts.Fahrenheit,
+			ScrapeTimeout:       opts.ScrapeTimeout.String(),
+			LegacyLoadMetrics:   opts.LegacyLoadMetrics,
+			DiskTemperatureWarn: opts.DiskTemperatureWarn,
+		}
+		for _, exporter := range exporters {
+			effective.Diskstations = append(effective.Diskstations, newDiskstationConfig(exporter))
+		}
+		for _, target := range cfg.Targets {
+			effective.ProbeTargets = append(effective.ProbeTargets, target.Diskstation)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(effective)
+	}
+}
+
+// collectOnce collects the metrics of the Diskstations, and writes them in
+// the Prometheus text format. It returns an error if a collection failed.
+func collectOnce(exporters []*Exporter, w io.Writer) error {
+	if err := writeMetrics(exporters, w); err != nil {
+		return err
+	}
+	return lastScrapeError(exporters)
+}
+
+// writeMetrics collects the metrics of the Diskstations, and writes them in
+// the Prometheus text format.
+func writeMetrics(exporters []*Exporter, w io.Writer) error {
+	registry := prometheus.NewRegistry()
+	for _, exporter := range exporters {
+		if err := registry.Register(exporter); err != nil {
+			return fmt.Errorf("Can't register the exporter of %s: %s", exporter.Client.Diskstation, err)
+		}
+	}
+	mfs, err := registry.Gather()
+	if err != nil {
+		return fmt.Errorf("Can't gather the metrics: %s", err)
+	}
+	encoder := expfmt.NewEncoder(w, expfmt.FmtText)
+	for _, mf := range mfs {
+		if err := encoder.Encode(mf); err != nil {
+			return fmt.Errorf("Can't write the metrics: %s", err)
+		}
+	}
+	return nil
+}
+
+// lastScrapeError returns the errors of the last collections, if some
+// failed
+func lastScrapeError(exporters []*Exporter) error {
+	var failed []string
+	for _, exporter := range exporters {
+		_, errs := exporter.LastScrape()
+		if len(errs) == 0 {
+			continue
+		}
+		messages := make([]string, len(errs))
+		for i, err := range errs {
+			messages[i] = err.Error()
+		}
+		failed = append(failed, fmt.Sprintf("Collection from %s failed: %s", exporter.Client.Diskstation, strings.Join(messages, "; ")))
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "\n"))
+	}
+	return nil
+}
+
+// writeTextfile collects the metrics of the Diskstations into the file, for
+// the textfile collector of the node exporter. They are written to a
+// temporary file of the same directory, renamed once complete, so the file
+// is never read half written.
+func writeTextfile(exporters []*Exporter, path string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return fmt.Errorf("Can't create the textfile: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+	if err := writeMetrics(exporters, tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("Can't write the textfile: %s", err)
+	}
+	// TempFile creates it readable by its owner only
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("Can't write the textfile: %s", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("Can't write the textfile: %s", err)
+	}
+	return nil
+}
+
+// textfileInterval returns the shortest interval of the Diskstations
+func textfileInterval(exporters []*Exporter) time.Duration {
+	interval := exporters[0].Client.Interval
+	for _, exporter := range exporters[1:] {
+		if exporter.Client.Interval < interval {
+			interval = exporter.Client.Interval
+		}
+	}
+	return interval
+}
+
+// runTextfile writes the metrics of the Diskstations into the file every
+// interval, until the context is done.
+func runTextfile(ctx context.Context, exporters []*Exporter, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := writeTextfile(exporters, path); err != nil {
+			log.Errorf("%s", err)
+		} else if err := lastScrapeError(exporters); err != nil {
+			log.Warnf("%s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// oidMap is the value of the repeatable name=oid flags: -custom.oid and
+// -oid.base
+type oidMap map[string]string
+
+func (c oidMap) String() string {
+	pairs := make([]string, 0, len(c))
+	for name, oid := range c {
+		pairs = append(pairs, name+"="+oid)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (c oidMap) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i <= 0 || i == len(value)-1 {
+		return fmt.Errorf("expected name=oid, got %s", value)
+	}
+	c[value[:i]] = value[i+1:]
+	return nil
+}
+
+// trapCollector exports the number of traps and informs sent by the
+// Diskstations to the trap receiver, by source and trap OID.
+type trapCollector struct {
+	receiver *syno.TrapReceiver
+	desc     *prometheus.Desc
+}
+
+func newTrapCollector(receiver *syno.TrapReceiver, namespace string) *trapCollector {
+	return &trapCollector{
+		receiver: receiver,
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "trap_received_total"),
+			"The number of SNMP traps and informs received, by source and trap OID.",
+			[]string{"source", "oid"}, nil,
+		),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *trapCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect implements prometheus.Collector.
+func (c *trapCollector) Collect(ch chan<- prometheus.Metric) {
+	for key, count := range c.receiver.Traps() {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.CounterValue, float64(count), key.Source, key.OID)
+	}
+}
+
+// metricsHandler writes the metrics of the registry. They are gzipped when
+// the scraper accepts it, as the output of several Diskstations or of each
+// network interface gets large.
+func metricsHandler(registry prometheus.Gatherer) http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{DisableCompression: false})
+}
+
+// newRegistry returns the registry of the exporter process, with the Go
+// runtime, process and build information collectors.
+func newRegistry() *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(prometheus.NewGoCollector())
+	registry.MustRegister(prometheus.NewProcessCollector(os.Getpid(), ""))
+	registry.MustRegister(prom_version.NewCollector("syno_exporter"))
+	return registry
 }
 
 func main() {
 	var (
-		showVersion   = flag.Bool("version", false, "Print version information.")
-		listenAddress = flag.String("web.listen-address", ":9111", "Address to listen on for web interface and telemetry.")
-		metricsPath   = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
-		diskstation   = flag.String("diskstation", "", "Disktation IP.")
-		//interval      = flag.Int("interval", 60*time.Second, "Interval for metrics.")
+		showVersion     = flag.Bool("version", false, "Print version information.")
+		listenAddress   = flag.String("web.listen-address", ":9111", "Address to listen on for web interface and telemetry.")
+		metricsPath     = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
+		routePrefix     = flag.String("web.route-prefix", "/", "Prefix of the paths of all the endpoints, when the exporter is served under a subpath by a reverse proxy.")
+		diskstation     = flag.String("diskstation", "", "Diskstation IP or host name. Leave empty to only probe targets using /snmp?target=.")
+		instanceName    = flag.String("instance-name", "", "Name of the Diskstation in the 'diskstation' label of the metrics. Defaults to its IP.")
+		configFile      = flag.String("config.file", "", "Path to the YAML configuration file describing the Diskstations.")
+		community       = flag.String("snmp.community", "public", "SNMP community.")
+		snmpVersion     = flag.String("snmp.version", "1", "SNMP version (1, 2c or 3).")
+		transport       = flag.String("snmp.transport", "udp", "SNMP transport (udp or tcp).")
+		localAddress    = flag.String("snmp.local-address", "", "Local IP address, optionally with a port, the SNMP requests are sent from. Empty to let the system choose.")
+		v3Username      = flag.String("snmp.v3-username", "", "SNMPv3 user name.")
+		v3AuthProtocol  = flag.String("snmp.v3-auth-protocol", "", "SNMPv3 authentication protocol (MD5, SHA, SHA224, SHA256, SHA384 or SHA512). Empty for no authentication.")
+		v3AuthPassword  = flag.String("snmp.v3-auth-password", "", "SNMPv3 authentication password.")
+		v3PrivProtocol  = flag.String("snmp.v3-priv-protocol", "", "SNMPv3 privacy protocol (DES, AES, AES192 or AES256). Empty for no privacy.")
+		v3PrivPassword  = flag.String("snmp.v3-priv-password", "", "SNMPv3 privacy password.")
+		v3ContextName   = flag.String("snmp.v3-context-name", "", "SNMPv3 context name of the requests.")
+		v3ContextEngine = flag.String("snmp.v3-context-engine-id", "", "SNMPv3 context engine ID of the requests, in hexadecimal. Empty for the engine ID of the agent.")
+		maxRepetitions  = flag.Int("snmp.max-repetitions", 0, "Number of values asked by the GetBulk requests walking the SNMP tables (SNMPv2c and v3). 0 for the gosnmp default (50).")
+		nonRepeaters    = flag.Int("snmp.non-repeaters", 0, "Number of non repeaters of the GetBulk requests walking the SNMP tables.")
+		maxOids         = flag.Int("snmp.max-oids", gosnmp.MaxOids, "Maximum number of OIDs of a SNMP Get request. Larger requests are split.")
+		snmpRetries     = flag.Int("snmp.retries", 0, "Number of times a SNMP request is sent again when the Diskstation doesn't answer. The 2s timeout of a request is split between its attempts.")
+		notIncreasing   = flag.Bool("snmp.skip-not-increasing", false, "Skip the variables whose OID doesn't increase in the SNMP walks, instead of failing the collector.")
+		resolveInterval = flag.Duration("snmp.resolve-interval", 0, "Interval to resolve again the Diskstation host name, if its IP changes. 0 to resolve it once.")
+		fahrenheit      = flag.Bool("temperature.fahrenheit", false, "Export temperatures in degrees Fahrenheit instead of Celsius.")
+		diskTempWarn    = flag.Float64("disk.temp-warn", 0, "Disk temperature, in the exported unit, above which syno_disk_temperature_exceeded is 1. 0 to disable.")
+		cacheMaxAge     = flag.Duration("cache.max-age", 5*time.Minute, "How long the last metrics are served when the Diskstation fails to answer. 0 to disable.")
+		scrapeTimeout   = flag.Duration("scrape.timeout", 10*time.Second, "Maximum duration of a collection from the Diskstation. 0 to disable.")
+		fetchRetries    = flag.Int("snmp.fetch-retries", syno.DefaultFetchRetries, "Number of retries, with an exponential backoff, of a collector whose SNMP requests timed out.")
+		concurrency     = flag.Int("snmp.concurrency", syno.DefaultConcurrency, "Number of collectors sending SNMP requests to a Diskstation at the same time, each on its own connection.")
+		legacyLoad      = flag.Bool("legacy-load-metrics", true, "Export the load averages as syno_load_short, syno_load_mid and syno_load_long too.")
+		namespace       = flag.String("metric.namespace", defaultNamespace, "Prefix of the names of the metrics.")
+		dryRun          = flag.Bool("dry-run", false, "Collect the metrics of the Diskstation once, print them and exit.")
+		cpuPerCore      = flag.Bool("cpu.per-core", false, "Export the load of each CPU core as syno_cpu_core_load.")
+		netPerInterface = flag.Bool("net.per-interface", false, "Export the traffic, errors and discards of each network interface.")
+		systemFanSpeed  = flag.Bool("system.fan-speed", false, "Export the speed of the fans as syno_system_fan_rpm, on the models which report it.")
+		collectors      = flag.String("collectors", "system,cpu,load,mem,net,disk,diskio,service,space,storage", "Comma-separated list of collectors to use.")
+		interval        = flag.Duration("interval", syno.DefaultInterval, "Interval between the writes of the metrics to the -textfile.path file.")
+		textfilePath    = flag.String("textfile.path", "", "File where the metrics are written every -interval, for the textfile collector of the node exporter. Empty to disable.")
+		trapAddress     = flag.String("trap.listen-address", "", "UDP address on which to receive the SNMPv2c traps and informs of the Diskstations, e.g. :162. Empty to disable.")
+		startupCheck    = flag.Bool("startup.check", false, "Exit at startup if a Diskstation doesn't answer SNMP requests, instead of retrying at each scrape.")
+		custom          = oidMap{}
+		oidBases        = oidMap{}
 	)
+	flag.Var(custom, "custom.oid", "Custom OID to export as syno_custom_<name>, as name=oid. Repeatable.")
+	flag.Var(oidBases, "oid.base", "Base OID of the SNMP MIB of a collector, as collector=oid, e.g. disk=.1.3.6.1.4.1.6574.2. Repeatable.")
 	flag.Parse()
 
 	if *showVersion {
@@ -405,29 +1875,210 @@ func main() {
 		os.Exit(0)
 	}
 
+	diskstations := parseDiskstations(*diskstation)
+	for _, address := range diskstations {
+		if address == "" {
+			continue
+		}
+		if err := syno.ValidateDiskstation(address); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -diskstation flag: %s\n", err)
+			flag.Usage()
+			os.Exit(2)
+		}
+	}
+	if len(diskstations) > 1 && *instanceName != "" {
+		fmt.Fprintln(os.Stderr, "-instance-name can't name several Diskstations: set their names in -config.file")
+		os.Exit(2)
+	}
+
+	if *concurrency < 1 {
+		fmt.Fprintf(os.Stderr, "Invalid -snmp.concurrency flag: %d\n", *concurrency)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if !namespaceRE.MatchString(*namespace) {
+		fmt.Fprintf(os.Stderr, "Invalid -metric.namespace flag: %s\n", *namespace)
+		flag.Usage()
+		os.Exit(2)
+	}
+
 	log.Infoln("Starting syno_exporter", prom_version.Info())
 	log.Infoln("Build context", prom_version.BuildContext())
 
-	interval := 60 * time.Second
-	exporter, err := NewExporter(*diskstation, interval)
-	if err != nil {
-		log.Errorf("Can't create exporter : %s", err)
-		os.Exit(1)
+	cfg := &config.Config{}
+	if *configFile != "" {
+		var err error
+		if cfg, err = config.Load(*configFile); err != nil {
+			log.Errorf("Can't load configuration: %s", err)
+			os.Exit(1)
+		}
 	}
-	log.Infoln("Register exporter")
-	prometheus.MustRegister(exporter)
 
-	http.Handle(*metricsPath, prometheus.Handler())
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`<html>
-             <head><title>Syno Exporter</title></head>
-             <body>
-             <h1>Syno Exporter</h1>
-             <p><a href='` + *metricsPath + `'>Metrics</a></p>
-             </body>
-             </html>`))
-	})
+	registry := newRegistry()
+	opts := Options{
+		Fahrenheit:          *fahrenheit,
+		ScrapeTimeout:       *scrapeTimeout,
+		FetchRetries:        *fetchRetries,
+		Concurrency:         *concurrency,
+		LegacyLoadMetrics:   *legacyLoad,
+		DiskTemperatureWarn: *diskTempWarn,
+		Namespace:           *namespace,
+	}
+	flags := config.Target{
+		Name:            *instanceName,
+		Community:       *community,
+		Version:         *snmpVersion,
+		Transport:       *transport,
+		LocalAddress:    *localAddress,
+		Interval:        *interval,
+		ResolveInterval: *resolveInterval,
+		MaxRepetitions:  *maxRepetitions,
+		NonRepeaters:    *nonRepeaters,
+		MaxOids:         *maxOids,
+		Retries:         *snmpRetries,
+		V3: config.V3{
+			Username:     *v3Username,
+			AuthProtocol: *v3AuthProtocol,
+			AuthPassword: *v3AuthPassword,
+			PrivProtocol: *v3PrivProtocol,
+			PrivPassword: *v3PrivPassword,
+
+			ContextName:     *v3ContextName,
+			ContextEngineID: *v3ContextEngine,
+		},
+		Plugins:           parseCollectors(*collectors),
+		CustomOIDs:        custom,
+		OIDBases:          oidBases,
+		CPUPerCore:        *cpuPerCore,
+		NetPerInterface:   *netPerInterface,
+		SystemFanSpeed:    *systemFanSpeed,
+		SkipNotIncreasing: *notIncreasing,
+	}
+	var exporters []*Exporter
+	for _, address := range diskstations {
+		flags.Diskstation = address
+		target := singleTarget(cfg, flags)
+		if target.Diskstation == "" {
+			continue
+		}
+		exporter, err := NewExporter(target, opts)
+		if err != nil {
+			log.Errorf("Can't create exporter : %s", err)
+			os.Exit(1)
+		}
+		exporter.Client.CacheMaxAge = *cacheMaxAge
+		exporters = append(exporters, exporter)
+	}
+
+	if *dryRun {
+		if len(exporters) == 0 {
+			fmt.Fprintln(os.Stderr, "-dry-run needs a Diskstation: set -diskstation")
+			os.Exit(2)
+		}
+		err := collectOnce(exporters, os.Stdout)
+		for _, exporter := range exporters {
+			exporter.Client.Close()
+		}
+		if err != nil {
+			log.Errorf("%s", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *textfilePath != "" && len(exporters) == 0 {
+		fmt.Fprintln(os.Stderr, "-textfile.path needs a Diskstation: set -diskstation")
+		os.Exit(2)
+	}
+
+	if *startupCheck {
+		for _, exporter := range exporters {
+			if err := exporter.Client.Ping(); err != nil {
+				log.Errorf("Can't reach the Diskstation %s: %s", exporter.Client.Diskstation, err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	prefix := normalizePrefix(*routePrefix)
+	for _, exporter := range exporters {
+		if err := registry.Register(exporter); err != nil {
+			log.Errorf("Can't register the exporter of %s: %s", exporter.Client.Diskstation, err)
+			os.Exit(1)
+		}
+		log.Infof("Exporting Diskstation %s on %s (SNMP v%s, collectors: %s, cache max age: %s)",
+			exporter.Client.Diskstation, prefix+*metricsPath, exporter.Client.SNMP.Version,
+			strings.Join(exporter.Client.PluginNames(), ","), *cacheMaxAge)
+	}
+	if len(exporters) == 0 {
+		log.Infof("No Diskstation exported on %s: set -diskstation to export one", prefix+*metricsPath)
+	}
+	log.Infof("Probing Diskstations on %s/snmp?target=<diskstation> (%d configured, scrape timeout: %s)",
+		prefix, len(cfg.Targets), opts.ScrapeTimeout)
 
-	log.Infoln("Listening on", *listenAddress)
-	log.Fatal(http.ListenAndServe(*listenAddress, nil))
+	var traps *syno.TrapReceiver
+	if *trapAddress != "" {
+		traps = syno.NewTrapReceiver()
+		registry.MustRegister(newTrapCollector(traps, opts.Namespace))
+		go func() {
+			log.Infoln("Receiving SNMP traps on", *trapAddress)
+			if err := traps.Listen(*trapAddress); err != nil {
+				log.Fatalf("Can't receive SNMP traps: %s", err)
+			}
+		}()
+	}
+
+	http.Handle(prefix+*metricsPath, metricsHandler(registry))
+	http.HandleFunc(prefix+"/snmp", snmpHandler(cfg, opts))
+	http.HandleFunc(prefix+"/healthz", healthzHandler(exporters))
+	http.HandleFunc(prefix+"/version", versionHandler)
+	http.HandleFunc(prefix+"/config", configHandler(cfg, exporters, opts))
+	if prefix != "" {
+		http.Handle(prefix, http.RedirectHandler(prefix+"/", http.StatusFound))
+	}
+	http.HandleFunc(prefix+"/", landingHandler(exporters, *metricsPath))
+
+	server := &http.Server{Addr: *listenAddress}
+	go func() {
+		log.Infoln("Listening on", *listenAddress)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	textfileCtx, stopTextfile := context.WithCancel(context.Background())
+	textfileDone := make(chan struct{})
+	if *textfilePath != "" {
+		interval := textfileInterval(exporters)
+		log.Infof("Writing the metrics to %s every %s", *textfilePath, interval)
+		go func() {
+			runTextfile(textfileCtx, exporters, *textfilePath, interval)
+			close(textfileDone)
+		}()
+	} else {
+		close(textfileDone)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+
+	log.Infof("Received %s, shutting down", sig)
+	stopTextfile()
+	<-textfileDone
+	if traps != nil {
+		traps.Close()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Errorf("Can't shutdown the HTTP server: %s", err)
+	}
+	for _, exporter := range exporters {
+		if err := exporter.Client.Close(); err != nil {
+			log.Errorf("Can't close the SNMP connection to %s: %s", exporter.Client.Diskstation, err)
+		}
+	}
+	log.Infoln("Syno exporter stopped")
 }
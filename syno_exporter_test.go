@@ -13,3 +13,421 @@
 // limitations under the License.
 
 package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/soniah/gosnmp"
+
+	"github.com/nlamirault/syno_exporter/config"
+	"github.com/nlamirault/syno_exporter/syno"
+	"github.com/nlamirault/syno_exporter/syno/plugins"
+	"github.com/nlamirault/syno_exporter/version"
+)
+
+func TestExportersWithPrivateRegistries(t *testing.T) {
+	for _, diskstation := range []string{"127.0.0.1", "127.0.0.2"} {
+		registry := prometheus.NewRegistry()
+		exporter, err := NewExporterWithRegistry(
+			&config.Target{Diskstation: diskstation}, Options{}, registry)
+		if err != nil {
+			t.Fatalf("Can't create exporter for %s: %s", diskstation, err)
+		}
+		defer exporter.Client.Close()
+
+		mfs, err := registry.Gather()
+		if err != nil {
+			t.Fatalf("Can't gather metrics for %s: %s", diskstation, err)
+		}
+		found := false
+		for _, mf := range mfs {
+			if mf.GetName() != "syno_scrape_duration_seconds" {
+				continue
+			}
+			found = true
+			labels := mf.GetMetric()[0].GetLabel()
+			if len(labels) != 1 || labels[0].GetName() != "diskstation" || labels[0].GetValue() != diskstation {
+				t.Fatalf("Invalid labels for %s: %v", diskstation, labels)
+			}
+		}
+		if !found {
+			t.Fatalf("Scrape duration not exported for %s", diskstation)
+		}
+	}
+}
+
+func TestBuildInfo(t *testing.T) {
+	mfs, err := newRegistry().Gather()
+	if err != nil {
+		t.Fatalf("Can't gather metrics: %s", err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() != "syno_exporter_build_info" {
+			continue
+		}
+		for _, label := range mf.GetMetric()[0].GetLabel() {
+			if label.GetName() == "version" && label.GetValue() != version.Version {
+				t.Fatalf("Invalid version: %s", label.GetValue())
+			}
+		}
+		return
+	}
+	t.Fatalf("Build info not exported")
+}
+
+func TestNormalizePrefix(t *testing.T) {
+	for prefix, expected := range map[string]string{
+		"":       "",
+		"/":      "",
+		"syno":   "/syno",
+		"/syno/": "/syno",
+		"/a/b":   "/a/b",
+	} {
+		if actual := normalizePrefix(prefix); actual != expected {
+			t.Errorf("Invalid prefix for %q: %q, expected %q", prefix, actual, expected)
+		}
+	}
+}
+
+// fakeSession is a SNMPv1 syno.Session answering with canned variables, in
+// their order
+type fakeSession struct {
+	variables []gosnmp.SnmpPDU
+}
+
+func (s fakeSession) SNMPVersion() gosnmp.SnmpVersion {
+	return gosnmp.Version1
+}
+
+func (s fakeSession) Connect() error {
+	return nil
+}
+
+func (s fakeSession) Close() error {
+	return nil
+}
+
+func (s fakeSession) Get(oids []string) (*gosnmp.SnmpPacket, error) {
+	result := &gosnmp.SnmpPacket{}
+	for _, oid := range oids {
+		variable := gosnmp.SnmpPDU{Name: oid, Type: gosnmp.NoSuchObject}
+		for _, v := range s.variables {
+			if v.Name == oid {
+				variable = v
+			}
+		}
+		result.Variables = append(result.Variables, variable)
+	}
+	return result, nil
+}
+
+func (s fakeSession) Walk(oid string) ([]gosnmp.SnmpPDU, error) {
+	var variables []gosnmp.SnmpPDU
+	for _, v := range s.variables {
+		if strings.HasPrefix(v.Name, oid+".") {
+			variables = append(variables, v)
+		}
+	}
+	if len(variables) == 0 {
+		// Like gosnmp, get the OID itself when there's nothing under it
+		for _, v := range s.variables {
+			if v.Name == oid {
+				variables = append(variables, v)
+			}
+		}
+	}
+	return variables, nil
+}
+
+func (s fakeSession) GetBulk(oids []string, nonRepeaters uint8, maxRepetitions uint8) (*gosnmp.SnmpPacket, error) {
+	return nil, fmt.Errorf("No GetBulk with SNMPv1")
+}
+
+func (s fakeSession) Set(pdus []gosnmp.SnmpPDU) (*gosnmp.SnmpPacket, error) {
+	return nil, fmt.Errorf("Read-only session")
+}
+
+func TestCollectWithFakeSession(t *testing.T) {
+	client, err := syno.NewClient("127.0.0.1", syno.DefaultInterval)
+	if err != nil {
+		t.Fatalf("Can't create client: %s", err)
+	}
+	client.NewSession = func(*gosnmp.GoSNMP) syno.Session {
+		return fakeSession{variables: []gosnmp.SnmpPDU{
+			{Name: ".1.3.6.1.4.1.6574.1.1.0", Type: gosnmp.Integer, Value: 1},
+			{Name: ".1.3.6.1.4.1.2021.4.5.0", Type: gosnmp.Integer, Value: 1000},
+			{Name: ".1.3.6.1.4.1.6574.6.1.1.2.1", Type: gosnmp.OctetString, Value: []byte("CIFS")},
+			{Name: ".1.3.6.1.4.1.6574.6.1.1.3.1", Type: gosnmp.Integer, Value: 3},
+		}}
+	}
+	if err := client.EnablePlugins([]string{"system", "mem", "service"}); err != nil {
+		t.Fatalf("Can't enable plugins: %s", err)
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(newExporter(client, "nas", Options{}))
+
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Can't gather metrics: %s", err)
+	}
+	expected := map[string]float64{
+		"syno_up":                           1,
+		"syno_exporter_last_scrape_error":   0,
+		"syno_exporter_scrape_errors_total": 0,
+		"syno_system_status":                1,
+		"syno_mem_total_real_bytes":         1024000,
+		"syno_service_connections":          3,
+	}
+	for _, mf := range mfs {
+		value, ok := expected[mf.GetName()]
+		if !ok {
+			continue
+		}
+		metric := mf.GetMetric()[0]
+		if got := metric.GetGauge().GetValue() + metric.GetCounter().GetValue(); got != value {
+			t.Fatalf("Invalid value for %s: %f", mf.GetName(), got)
+		}
+		delete(expected, mf.GetName())
+	}
+	if len(expected) > 0 {
+		t.Fatalf("Metrics not exported: %v", expected)
+	}
+}
+
+func TestCustomMetrics(t *testing.T) {
+	client, err := syno.NewClientFromConfig(&config.Target{
+		Diskstation: "127.0.0.1",
+		CustomOIDs: map[string]string{
+			"uptime":        ".1.3.6.1.2.1.1.3.0",
+			"volume_status": ".1.3.6.1.4.1.6574.3.1.1.3",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Can't create client: %s", err)
+	}
+	if err := client.EnablePlugins([]string{"custom"}); err != nil {
+		t.Fatalf("Can't enable plugins: %s", err)
+	}
+	client.NewSession = func(*gosnmp.GoSNMP) syno.Session {
+		return fakeSession{variables: []gosnmp.SnmpPDU{
+			{Name: ".1.3.6.1.2.1.1.3.0", Type: gosnmp.TimeTicks, Value: uint32(4200)},
+			{Name: ".1.3.6.1.4.1.6574.3.1.1.3.0", Type: gosnmp.Integer, Value: 1},
+			{Name: ".1.3.6.1.4.1.6574.3.1.1.3.1", Type: gosnmp.Integer, Value: 2},
+		}}
+	}
+	// Fails if a metric isn't described, or its labels don't match
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(newExporter(client, "nas", Options{}))
+
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Can't gather metrics: %s", err)
+	}
+	expected := map[string]float64{
+		"syno_up":                      1,
+		"syno_custom_uptime":           4200,
+		"syno_custom_volume_status{0}": 1,
+		"syno_custom_volume_status{1}": 2,
+	}
+	for _, mf := range mfs {
+		for _, metric := range mf.GetMetric() {
+			name := mf.GetName()
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "index" {
+					name += "{" + label.GetValue() + "}"
+				}
+			}
+			value, ok := expected[name]
+			if !ok {
+				continue
+			}
+			if got := metric.GetGauge().GetValue(); got != value {
+				t.Fatalf("Invalid value for %s: %f", name, got)
+			}
+			delete(expected, name)
+		}
+	}
+	if len(expected) > 0 {
+		t.Fatalf("Metrics not exported: %v", expected)
+	}
+}
+
+func TestCustomMetricsWithScalarAndRows(t *testing.T) {
+	client, err := syno.NewClientFromConfig(&config.Target{
+		Diskstation: "127.0.0.1",
+		CustomOIDs: map[string]string{
+			"volume_status": ".1.3.6.1.4.1.6574.3.1.1.3",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Can't create client: %s", err)
+	}
+	if err := client.EnablePlugins([]string{"custom"}); err != nil {
+		t.Fatalf("Can't enable plugins: %s", err)
+	}
+	// The table column has a value of its own
+	client.NewSession = func(*gosnmp.GoSNMP) syno.Session {
+		return fakeSession{variables: []gosnmp.SnmpPDU{
+			{Name: ".1.3.6.1.4.1.6574.3.1.1.3", Type: gosnmp.Integer, Value: 1},
+		}}
+	}
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(newExporter(client, "nas", Options{}))
+
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Can't gather metrics: %s", err)
+	}
+	for _, mf := range mfs {
+		switch mf.GetName() {
+		case "syno_custom_volume_status":
+			t.Fatalf("Scalar of a table column exported: %v", mf)
+		case "syno_up":
+			if up := mf.GetMetric()[0].GetGauge().GetValue(); up != 0 {
+				t.Fatalf("Invalid value for syno_up: %f", up)
+			}
+		}
+	}
+}
+
+func TestDescribeMetrics(t *testing.T) {
+	client, err := syno.NewClient("127.0.0.1", syno.DefaultInterval)
+	if err != nil {
+		t.Fatalf("Can't create client: %s", err)
+	}
+	for _, metric := range describeMetrics(newExporter(client, "", Options{})) {
+		if metric.Name != "syno_disk_info" {
+			continue
+		}
+		if metric.Labels != "disk, id, model, enclosure" || metric.Help == "" {
+			t.Fatalf("Invalid description: %v", metric)
+		}
+		return
+	}
+	t.Fatalf("syno_disk_info not described")
+}
+
+func TestConfigHandler(t *testing.T) {
+	exporter, err := NewExporter(&config.Target{
+		Diskstation:  "127.0.0.1",
+		Version:      "3",
+		LocalAddress: "127.0.0.1",
+		V3: config.V3{
+			Username:     "admin",
+			AuthProtocol: "SHA",
+			AuthPassword: "authpass",
+			PrivProtocol: "AES",
+			PrivPassword: "privpass",
+
+			ContextName:     "vlan1",
+			ContextEngineID: "0x80001f8880",
+		},
+	}, Options{})
+	if err != nil {
+		t.Fatalf("Can't create exporter: %s", err)
+	}
+	defer exporter.Client.Close()
+
+	recorder := httptest.NewRecorder()
+	configHandler(&config.Config{}, []*Exporter{exporter}, Options{}).ServeHTTP(
+		recorder, httptest.NewRequest("GET", "/config", nil))
+	body := recorder.Body.String()
+	if strings.Contains(body, "authpass") || strings.Contains(body, "privpass") || strings.Contains(body, "public") {
+		t.Fatalf("Secrets not redacted: %s", body)
+	}
+	var effective struct {
+		Diskstations []diskstationConfig `json:"diskstations"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &effective); err != nil {
+		t.Fatalf("Invalid JSON: %s", err)
+	}
+	if len(effective.Diskstations) != 1 {
+		t.Fatalf("Invalid Diskstations: %s", body)
+	}
+	ds := effective.Diskstations[0]
+	if ds.Target != "127.0.0.1:161" || ds.Version != "3" || ds.V3 == nil ||
+		ds.V3.Username != "admin" || ds.V3.AuthPassword != redacted || ds.V3.PrivPassword != redacted ||
+		ds.V3.ContextName != "vlan1" || ds.LocalAddress != "127.0.0.1" {
+		t.Fatalf("Invalid configuration: %s", body)
+	}
+
+	// The keys of the SNMPv3 settings are the ones of the configuration file
+	var keys struct {
+		Diskstations []struct {
+			V3 map[string]string `json:"v3"`
+		} `json:"diskstations"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &keys); err != nil {
+		t.Fatalf("Invalid JSON: %s", err)
+	}
+	expected := map[string]string{
+		"username":          "admin",
+		"auth_protocol":     "SHA",
+		"auth_password":     redacted,
+		"priv_protocol":     "AES",
+		"priv_password":     redacted,
+		"context_name":      "vlan1",
+		"context_engine_id": "0x80001f8880",
+	}
+	if v3 := keys.Diskstations[0].V3; !reflect.DeepEqual(v3, expected) {
+		t.Fatalf("Invalid SNMPv3 configuration: %v", v3)
+	}
+}
+
+// cpuMetrics returns the CPU tick counters of a scrape
+func cpuMetrics(user, nice, system, idle, wait float64) *plugins.CPUMetrics {
+	return &plugins.CPUMetrics{User: &user, Nice: &nice, System: &system, Idle: &idle, Wait: &wait}
+}
+
+func TestCPUUsage(t *testing.T) {
+	exporter := &Exporter{}
+	if _, ok := exporter.cpuUsage(cpuMetrics(100, 0, 50, 800, 50)); ok {
+		t.Fatalf("CPU usage without previous scrape")
+	}
+	if usage, ok := exporter.cpuUsage(cpuMetrics(130, 0, 60, 850, 60)); !ok || usage != 50 {
+		t.Fatalf("Invalid CPU usage: %f %t", usage, ok)
+	}
+	if usage, ok := exporter.cpuUsage(cpuMetrics(0, 0, 60, 850, 60)); ok {
+		t.Fatalf("CPU usage with a wrapped counter: %f", usage)
+	}
+}
+
+func TestMetricsHandlerCompression(t *testing.T) {
+	handler := metricsHandler(newRegistry())
+
+	request := httptest.NewRequest("GET", "/metrics", nil)
+	request.Header.Set("Accept-Encoding", "gzip")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if encoding := recorder.Header().Get("Content-Encoding"); encoding != "gzip" {
+		t.Fatalf("Invalid content encoding: %q", encoding)
+	}
+	reader, err := gzip.NewReader(recorder.Body)
+	if err != nil {
+		t.Fatalf("Invalid gzipped response: %s", err)
+	}
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Invalid gzipped response: %s", err)
+	}
+	if !strings.Contains(string(body), "syno_exporter_build_info") {
+		t.Fatalf("Invalid metrics: %s", body)
+	}
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if encoding := recorder.Header().Get("Content-Encoding"); encoding != "" {
+		t.Fatalf("Response compressed without Accept-Encoding: %q", encoding)
+	}
+	if !strings.Contains(recorder.Body.String(), "syno_exporter_build_info") {
+		t.Fatalf("Invalid metrics: %s", recorder.Body.String())
+	}
+}
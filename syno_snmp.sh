@@ -45,9 +45,9 @@ snmpget -v 1 -c ${COMMUNITY} ${DS_STATION} ".1.3.6.1.4.1.6574.2.1.1.6.0"
 # snmpget -v 1 -c ${COMMUNITY} ${DS_STATION} ".1.3.6.1.4.1.6574.2.1.1.6.1"
 
 echo -e "${OK_COLOR}=== Try SNMP Load ===${NO_COLOR}"
-snmpget -v 1 -c ${COMMUNITY} ${DS_STATION} ".1.3.6.1.4.1.2021.10.1.5.1"
-snmpget -v 1 -c ${COMMUNITY} ${DS_STATION} ".1.3.6.1.4.1.2021.10.1.5.2"
-snmpget -v 1 -c ${COMMUNITY} ${DS_STATION} ".1.3.6.1.4.1.2021.10.1.5.3"
+snmpget -v 1 -c ${COMMUNITY} ${DS_STATION} ".1.3.6.1.4.1.2021.10.1.6.1"
+snmpget -v 1 -c ${COMMUNITY} ${DS_STATION} ".1.3.6.1.4.1.2021.10.1.6.2"
+snmpget -v 1 -c ${COMMUNITY} ${DS_STATION} ".1.3.6.1.4.1.2021.10.1.6.3"
 
 echo -e "${OK_COLOR}=== Try SNMP Memory ===${NO_COLOR}"
 snmpget -v 1 -c ${COMMUNITY} ${DS_STATION} ".1.3.6.1.4.1.2021.4.3.0" # memTotalSwap